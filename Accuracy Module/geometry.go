@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gocv.io/x/gocv"
+)
+
+// The placement of the reference markers on the floor, in track coordinates
+type MarkerLayout struct {
+	Dictionary  string            `json:"dictionary"`  // ArUco dictionary, e.g. "4x4_50"
+	RoverMarker int               `json:"roverMarker"` // id of the marker on top of the rover
+	Markers     []ReferenceMarker `json:"markers"`
+}
+
+type ReferenceMarker struct {
+	Id int     `json:"id"`
+	X  float64 `json:"x"` // center of the marker in meters
+	Y  float64 `json:"y"`
+}
+
+// Reads a json file into the given value
+func loadJson(path string, value interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+func loadLayout(path string) (*MarkerLayout, error) {
+	layout := &MarkerLayout{}
+	err := loadJson(path, layout)
+	if err != nil {
+		return nil, err
+	}
+	if len(layout.Markers) < 4 {
+		return nil, fmt.Errorf("layout %s needs at least 4 reference markers, got %d", path, len(layout.Markers))
+	}
+	for _, marker := range layout.Markers {
+		if marker.Id == layout.RoverMarker {
+			return nil, fmt.Errorf("layout %s uses marker %d both as reference and as rover marker", path, marker.Id)
+		}
+	}
+	return layout, nil
+}
+
+// A planar homography, maps image coordinates to track coordinates
+type homography [9]float64
+
+// Estimates the homography that maps src onto dst (at least 4 point pairs), using least squares over all pairs when
+// more than 4 are given
+func estimateHomography(src [][2]float64, dst [][2]float64) (homography, error) {
+	if len(src) < 4 || len(src) != len(dst) {
+		return homography{}, fmt.Errorf("need at least 4 point pairs, got %d", len(src))
+	}
+
+	srcPoints := pointsMat(src)
+	defer srcPoints.Close()
+	dstPoints := pointsMat(dst)
+	defer dstPoints.Close()
+	mask := gocv.NewMat()
+	defer mask.Close()
+
+	solution := gocv.FindHomography(srcPoints, &dstPoints, gocv.HomographyMethodAllPoints, 3, &mask, 2000, 0.995)
+	defer solution.Close()
+	if solution.Empty() {
+		return homography{}, fmt.Errorf("degenerate point configuration (are the reference markers collinear?)")
+	}
+	h := homography{}
+	for i := range h {
+		h[i] = solution.GetDoubleAt(i/3, i%3)
+	}
+	return h, nil
+}
+
+// Returns the points as a n x 1 two channel Mat, the layout FindHomography expects. Close it after use.
+func pointsMat(points [][2]float64) gocv.Mat {
+	mat := gocv.NewMatWithSize(len(points), 1, gocv.MatTypeCV64FC2)
+	for i, p := range points {
+		mat.SetDoubleAt(i, 0, p[0])
+		mat.SetDoubleAt(i, 1, p[1])
+	}
+	return mat
+}
+
+// Maps a point through the homography
+func (h homography) apply(x float64, y float64) (float64, float64) {
+	w := h[6]*x + h[7]*y + h[8]
+	return (h[0]*x + h[1]*y + h[2]) / w, (h[3]*x + h[4]*y + h[5]) / w
+}
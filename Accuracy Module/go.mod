@@ -0,0 +1,8 @@
+module rover/accuracy
+
+go 1.22
+
+require rover/track v0.0.0
+
+// The shared track package lives next to this module in the checkout
+replace rover/track => ../track
@@ -0,0 +1,188 @@
+// Lane-centering accuracy metric.
+//
+// An overhead camera films the track, with ArUco reference markers at known positions on the floor and one
+// marker on top of the rover. For every frame the reference markers give the homography from the image to
+// the track plane, which maps the rover marker into track coordinates. Its lateral deviation from the
+// centerline of the track is written per frame and summarized as RMS/max error, so every controller change
+// can be scored on the same track.
+//
+// Usage:
+//
+//	go run . -video run.mp4 -layout layout.json -track track.json -out run.csv
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+
+	"rover/track"
+)
+
+var arucoDictionaries = map[string]gocv.ArucoDictionaryCode{
+	"4x4_50":  gocv.ArucoDict4x4_50,
+	"4x4_100": gocv.ArucoDict4x4_100,
+	"5x5_50":  gocv.ArucoDict5x5_50,
+	"6x6_50":  gocv.ArucoDict6x6_50,
+	"6x6_250": gocv.ArucoDict6x6_250,
+}
+
+// Accumulates the lateral deviation over all frames in which the rover was found
+type accuracyReport struct {
+	frames     int
+	measured   int
+	sumSquared float64
+	sumAbs     float64
+	maxAbs     float64
+}
+
+func (r *accuracyReport) add(deviation float64) {
+	r.measured++
+	r.sumSquared += deviation * deviation
+	r.sumAbs += math.Abs(deviation)
+	r.maxAbs = math.Max(r.maxAbs, math.Abs(deviation))
+}
+
+// Returns the center of a detected marker
+func markerCenter(corners []gocv.Point2f) (float64, float64) {
+	x, y := 0.0, 0.0
+	for _, corner := range corners {
+		x += float64(corner.X)
+		y += float64(corner.Y)
+	}
+	return x / float64(len(corners)), y / float64(len(corners))
+}
+
+func run() error {
+	videoPath := flag.String("video", "", "overhead video of the run")
+	layoutPath := flag.String("layout", "", "json file with the reference marker layout")
+	trackPath := flag.String("track", "", "json file with the track centerline (simulator track format)")
+	outPath := flag.String("out", "", "csv file to write the per-frame deviation to (optional)")
+	flag.Parse()
+	if *videoPath == "" || *layoutPath == "" || *trackPath == "" {
+		flag.Usage()
+		return fmt.Errorf("-video, -layout and -track are required")
+	}
+
+	layout, err := loadLayout(*layoutPath)
+	if err != nil {
+		return err
+	}
+	track, err := track.Load(*trackPath)
+	if err != nil {
+		return err
+	}
+	dictionary, ok := arucoDictionaries[layout.Dictionary]
+	if !ok {
+		return fmt.Errorf("unknown ArUco dictionary %q", layout.Dictionary)
+	}
+	references := map[int]ReferenceMarker{}
+	for _, marker := range layout.Markers {
+		references[marker.Id] = marker
+	}
+
+	var csv *os.File
+	if *outPath != "" {
+		csv, err = os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer csv.Close()
+		fmt.Fprintln(csv, "frame,time,x,y,heading,deviation,reference_markers")
+	}
+
+	video, err := gocv.VideoCaptureFile(*videoPath)
+	if err != nil {
+		return err
+	}
+	defer video.Close()
+	fps := video.Get(gocv.VideoCaptureFPS)
+	if fps <= 0 {
+		fps = 30
+	}
+
+	detector := gocv.NewArucoDetectorWithParams(gocv.GetPredefinedDictionary(dictionary), gocv.NewArucoDetectorParameters())
+	defer detector.Close()
+
+	frame := gocv.NewMat()
+	defer frame.Close()
+
+	report := accuracyReport{}
+	// The overhead camera is static, so the last good homography is reused when reference markers are occluded
+	var imageToTrack *homography
+	for index := 0; video.Read(&frame); index++ {
+		if frame.Empty() {
+			continue
+		}
+		report.frames++
+
+		corners, ids, _ := detector.DetectMarkers(frame)
+		var roverCorners []gocv.Point2f
+		imagePoints := [][2]float64{}
+		trackPoints := [][2]float64{}
+		for i, id := range ids {
+			if id == layout.RoverMarker {
+				roverCorners = corners[i]
+				continue
+			}
+			if reference, ok := references[id]; ok {
+				x, y := markerCenter(corners[i])
+				imagePoints = append(imagePoints, [2]float64{x, y})
+				trackPoints = append(trackPoints, [2]float64{reference.X, reference.Y})
+			}
+		}
+
+		if len(imagePoints) >= 4 {
+			h, err := estimateHomography(imagePoints, trackPoints)
+			if err != nil {
+				log.Warn().Err(err).Int("frame", index).Msg("Failed to estimate homography")
+			} else {
+				imageToTrack = &h
+			}
+		}
+		if imageToTrack == nil {
+			log.Debug().Int("frame", index).Int("references", len(imagePoints)).Msg("Not enough reference markers yet")
+			continue
+		}
+		if roverCorners == nil {
+			log.Debug().Int("frame", index).Msg("Rover marker not found")
+			continue
+		}
+
+		// Position is the marker center, heading points from the center to the middle of the top edge (the first two corners)
+		x, y := imageToTrack.apply(markerCenter(roverCorners))
+		topX, topY := imageToTrack.apply(markerCenter(roverCorners[0:2]))
+		heading := math.Atan2(topY-y, topX-x)
+		deviation := track.CrossTrackError(x, y)
+		report.add(deviation)
+
+		if csv != nil {
+			fmt.Fprintf(csv, "%d,%.3f,%.4f,%.4f,%.4f,%.4f,%d\n", index, float64(index)/fps, x, y, heading, deviation, len(imagePoints))
+		}
+	}
+
+	if report.measured == 0 {
+		return fmt.Errorf("the rover was not found in any of the %d frames", report.frames)
+	}
+	log.Info().
+		Int("frames", report.frames).
+		Int("measured", report.measured).
+		Float64("rms", math.Sqrt(report.sumSquared/float64(report.measured))).
+		Float64("mean", report.sumAbs/float64(report.measured)).
+		Float64("max", report.maxAbs).
+		Msg("Lateral deviation from the centerline (meters)")
+	return nil
+}
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	err := run()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Accuracy metric failed")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Tuning API, so the controller can be tuned headless and from scripts
+//
+//   GET /api/tuning          all values as a json object
+//   PUT /api/tuning          change one or more values, e.g. {"kp": 0.003, "speed": 0.3}
+//   GET /api/tuning/<name>   a single value, e.g. GET /api/tuning/kd
+//   PUT /api/tuning/<name>   change a single value, the body is the json value, e.g. 0.0005 or "mpc"
+//
+// Changes are validated (see applyTuning), invalid values are rejected with 400 Bad Request.
+
+func registerTuningApi(mux *http.ServeMux) {
+	mux.HandleFunc("/api/tuning", serveTuning)
+	mux.HandleFunc("/api/tuning/", serveTuningValue)
+}
+
+func serveTuning(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, currentTuning())
+	case http.MethodPut:
+		update := tuningUpdate{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&update)
+		if err != nil {
+			http.Error(w, "invalid tuning: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := applyTuning(update, "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, updated)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func serveTuningValue(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/tuning/")
+
+	// Go through the json representation, so the names are the same as in the full object
+	values := map[string]json.RawMessage{}
+	current, _ := json.Marshal(currentTuning())
+	_ = json.Unmarshal(current, &values)
+	if _, ok := values[name]; !ok {
+		http.Error(w, "unknown tuning value "+name, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, values[name])
+	case http.MethodPut:
+		value := json.RawMessage{}
+		err := json.NewDecoder(r.Body).Decode(&value)
+		if err != nil {
+			http.Error(w, "invalid value: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := json.Marshal(map[string]json.RawMessage{name: value})
+		update := tuningUpdate{}
+		err = json.NewDecoder(bytes.NewReader(body)).Decode(&update)
+		if err != nil {
+			http.Error(w, "invalid value for "+name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := applyTuning(update, "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, updated)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to write api response")
+	}
+}
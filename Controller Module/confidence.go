@@ -0,0 +1,34 @@
+package main
+
+// Weighs the steering decisions by the confidence the imaging module has in its detection (see its confidence.go).
+// Frames below the minimum are not steered on, the previous steering is kept. Below the slowdown confidence the
+// new steering is blended with the previous one and the throttle is lowered, both in proportion to the confidence.
+type confidenceGate struct {
+	minimum  float64
+	slowdown float64
+	steering float64 // the last steering value, before it is inverted for the actuator
+}
+
+// Returns whether the steering controller should be updated with a frame of the given confidence
+func (g *confidenceGate) trusted(confidence float64) bool {
+	return confidence >= g.minimum
+}
+
+// Weighs a (clamped) steering value and the throttle by the confidence
+func (g *confidenceGate) apply(confidence float64, steering float64, speed float32) (float64, float32) {
+	if !g.trusted(confidence) {
+		steering = g.steering
+	}
+	weight := 1.0
+	if g.slowdown > 0 {
+		weight = min(max(confidence/g.slowdown, 0), 1)
+	}
+	steering = g.steering + weight*(steering-g.steering)
+	g.steering = steering
+	return steering, speed * float32(weight)
+}
+
+// Forgets the previous steering, call this when the rover stopped
+func (g *confidenceGate) reset() {
+	g.steering = 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// Number of samples kept for clients that just connected (about 10 seconds at 30 fps)
+const telemetryHistory = 300
+
+// The loop is considered stale if no imaging frame arrived for this long
+const watchdogTimeout = 500 * time.Millisecond
+
+// A snapshot of the control loop, sent to the dashboard for every frame
+type telemetry struct {
+	Time         int64   `json:"time"` // unix milliseconds
+	Controller   string  `json:"controller"`
+	Error        float64 `json:"error"`
+	Proportional float64 `json:"p"`
+	Integral     float64 `json:"i"`
+	Derivative   float64 `json:"d"`
+	Steering     float64 `json:"steering"`
+	Throttle     float64 `json:"throttle"`
+	Fps          float64 `json:"fps"`
+	Watchdog     string  `json:"watchdog"` // "ok" while frames arrive, "stale" otherwise, "camera" while the imaging camera is unhealthy, "obstacle" while stopped for an obstacle, "lost" while stopped without a lane or without frames to steer on
+}
+
+// Serves a live view of the control loop over HTTP and streams telemetry to all connected WebSocket clients
+type dashboard struct {
+	lock       sync.Mutex
+	history    []telemetry
+	clients    map[chan telemetry]struct{}
+	lastUpdate time.Time
+	upgrader   websocket.Upgrader
+}
+
+func newDashboard() *dashboard {
+	d := &dashboard{
+		clients: map[chan telemetry]struct{}{},
+		// The default origin check only accepts connections from the page served by this server, so another site open
+		// in the same browser cannot read the telemetry
+		upgrader: websocket.Upgrader{},
+	}
+	go d.watchdog()
+	return d
+}
+
+// Adds the dashboard routes to the given mux
+func (d *dashboard) register(mux *http.ServeMux) {
+	mux.HandleFunc("/", d.servePage)
+	mux.HandleFunc("/ws", d.serveWebsocket)
+}
+
+// Publishes a new sample of the control loop
+func (d *dashboard) publish(sample telemetry) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.lastUpdate = time.Now()
+	d.broadcast(sample)
+}
+
+// Must be called with the lock held
+func (d *dashboard) broadcast(sample telemetry) {
+	d.history = append(d.history, sample)
+	if len(d.history) > telemetryHistory {
+		d.history = d.history[len(d.history)-telemetryHistory:]
+	}
+	for client := range d.clients {
+		select {
+		case client <- sample:
+		default:
+			// Slow client, it will catch up with the next sample
+		}
+	}
+}
+
+// Marks the loop as stale when the imaging frames stop arriving
+func (d *dashboard) watchdog() {
+	ticker := time.NewTicker(watchdogTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.lock.Lock()
+		if len(d.history) > 0 && time.Since(d.lastUpdate) > watchdogTimeout {
+			sample := d.history[len(d.history)-1]
+			sample.Time = time.Now().UnixMilli()
+			sample.Fps = 0
+			sample.Watchdog = "stale"
+			d.broadcast(sample)
+		}
+		d.lock.Unlock()
+	}
+}
+
+func (d *dashboard) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardPage)
+}
+
+func (d *dashboard) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := d.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to upgrade dashboard connection")
+		return
+	}
+	defer conn.Close()
+	log.Info().Str("client", r.RemoteAddr).Msg("Dashboard client connected")
+
+	client := make(chan telemetry, 64)
+	d.lock.Lock()
+	history := append([]telemetry{}, d.history...)
+	d.clients[client] = struct{}{}
+	d.lock.Unlock()
+	defer func() {
+		d.lock.Lock()
+		delete(d.clients, client)
+		d.lock.Unlock()
+		log.Info().Str("client", r.RemoteAddr).Msg("Dashboard client disconnected")
+	}()
+
+	// Detect closed connections, the client never sends anything
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, sample := range history {
+		if err := d.write(conn, sample); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case sample := <-client:
+			if err := d.write(conn, sample); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *dashboard) write(conn *websocket.Conn, sample telemetry) error {
+	err := conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(sample)
+}
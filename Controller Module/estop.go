@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Emergency stop, latches zero throttle and neutral steering on the decision output until it is cleared
+//
+//   GET    /api/estop             the current state as a json object
+//   POST   /api/estop             stop the rover
+//   DELETE /api/estop             clear the stop, refused while the dead-man heartbeat is missing
+//   POST   /api/estop/heartbeat   keep the dead-man alive, returns the current state
+//
+// With the dead-man enabled (deadman-timeout-ms option) the operator has to send heartbeats, the rover
+// stops as soon as they go quiet for longer than the timeout, also before the first heartbeat arrived.
+
+type emergencyStop struct {
+	lock          sync.Mutex
+	latched       bool
+	reason        string
+	since         time.Time
+	deadman       time.Duration // 0 disables the dead-man
+	lastHeartbeat time.Time
+}
+
+// The state of the emergency stop as served by the api
+type estopStatus struct {
+	Stopped          bool   `json:"stopped"`
+	Reason           string `json:"reason"`
+	Since            int64  `json:"since"` // unix milliseconds, 0 when not stopped
+	DeadmanTimeoutMs int64  `json:"deadman-timeout-ms"`
+	HeartbeatAgeMs   int64  `json:"heartbeat-age-ms"`
+}
+
+// Global, since the keyboard, the api and the main loop all use it
+var estop = &emergencyStop{lastHeartbeat: time.Now()}
+
+// Enables the dead-man with the given timeout, 0 disables it
+func (e *emergencyStop) setDeadman(timeout time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.deadman = timeout
+	e.lastHeartbeat = time.Now()
+}
+
+// Latches the stop, a stop that is already latched keeps its original reason
+func (e *emergencyStop) trigger(reason string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.latch(reason)
+}
+
+// Must be called with the lock held
+func (e *emergencyStop) latch(reason string) {
+	if e.latched {
+		return
+	}
+	e.latched = true
+	e.reason = reason
+	e.since = time.Now()
+	log.Warn().Str("reason", reason).Msg("Emergency stop")
+}
+
+// Clears the stop, the rover drives again with the next decision
+func (e *emergencyStop) clear(source string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.deadman > 0 && time.Since(e.lastHeartbeat) > e.deadman {
+		return fmt.Errorf("no heartbeat in the last %s, send a heartbeat before clearing the stop", e.deadman)
+	}
+	if e.latched {
+		log.Warn().Str("source", source).Str("reason", e.reason).Msg("Emergency stop cleared")
+	}
+	e.latched = false
+	e.reason = ""
+	return nil
+}
+
+func (e *emergencyStop) heartbeat() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.lastHeartbeat = time.Now()
+}
+
+// Returns if the rover must stop, trips the dead-man if the heartbeat went quiet
+func (e *emergencyStop) stopped() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.checkDeadman()
+	return e.latched
+}
+
+func (e *emergencyStop) status() estopStatus {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.checkDeadman()
+	status := estopStatus{
+		Stopped:          e.latched,
+		Reason:           e.reason,
+		DeadmanTimeoutMs: e.deadman.Milliseconds(),
+		HeartbeatAgeMs:   time.Since(e.lastHeartbeat).Milliseconds(),
+	}
+	if e.latched {
+		status.Since = e.since.UnixMilli()
+	}
+	return status
+}
+
+// Must be called with the lock held
+func (e *emergencyStop) checkDeadman() {
+	if e.deadman > 0 && time.Since(e.lastHeartbeat) > e.deadman {
+		e.latch("dead-man")
+	}
+}
+
+// Returns the decision that overrides the steering controller and its name for the dashboard, overrides is false when
+// the steering controller decides. The emergency stop wins over manual driving.
+func overrideDecision(command driveCommand, stopped bool) (steering float32, throttle float32, mode string, overrides bool) {
+	if stopped {
+		return 0, 0, "stopped", true
+	}
+	if !command.autonomous {
+		return command.steering, command.throttle, "manual", true
+	}
+	return 0, 0, "", false
+}
+
+func registerEstopApi(mux *http.ServeMux) {
+	mux.HandleFunc("/api/estop", serveEstop)
+	mux.HandleFunc("/api/estop/heartbeat", serveHeartbeat)
+}
+
+func serveEstop(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		estop.trigger("api (" + r.RemoteAddr + ")")
+	case http.MethodDelete:
+		err := estop.clear("api (" + r.RemoteAddr + ")")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, estop.status())
+}
+
+func serveHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	estop.heartbeat()
+	writeJson(w, estop.status())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Checks the decision a few times, as the main loop does every poll
+func expectStopped(t *testing.T, e *emergencyStop, command driveCommand, want bool) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		stopped := e.stopped()
+		if stopped != want {
+			t.Fatalf("stopped %v, want %v", stopped, want)
+		}
+		steering, throttle, mode, overrides := overrideDecision(command, stopped)
+		if want && (!overrides || steering != 0 || throttle != 0 || mode != "stopped") {
+			t.Fatalf("decision %f, %f (%s) while stopped, want zero", steering, throttle, mode)
+		}
+	}
+}
+
+func TestEmergencyStopLatches(t *testing.T) {
+	e := &emergencyStop{lastHeartbeat: time.Now()}
+	manual := driveCommand{steering: 0.5, throttle: 0.3}
+	expectStopped(t, e, driveCommand{autonomous: true}, false)
+
+	e.trigger("test")
+	expectStopped(t, e, driveCommand{autonomous: true}, true)
+	// Manual driving does not get past the stop either
+	expectStopped(t, e, manual, true)
+	// Nor does a heartbeat or another trigger
+	e.heartbeat()
+	e.trigger("again")
+	expectStopped(t, e, manual, true)
+	if reason := e.status().Reason; reason != "test" {
+		t.Errorf("reason %q, want the reason of the first trigger", reason)
+	}
+
+	if err := e.clear("test"); err != nil {
+		t.Fatal(err)
+	}
+	expectStopped(t, e, driveCommand{autonomous: true}, false)
+	if status := e.status(); status.Stopped || status.Reason != "" || status.Since != 0 {
+		t.Errorf("status %+v after clearing", status)
+	}
+}
+
+func TestEmergencyStopDeadman(t *testing.T) {
+	e := &emergencyStop{}
+	e.setDeadman(100 * time.Millisecond)
+	expectStopped(t, e, driveCommand{autonomous: true}, false)
+
+	// The heartbeat went quiet
+	e.lastHeartbeat = time.Now().Add(-time.Second)
+	expectStopped(t, e, driveCommand{autonomous: true}, true)
+	if reason := e.status().Reason; reason != "dead-man" {
+		t.Errorf("reason %q, want dead-man", reason)
+	}
+	if err := e.clear("test"); err == nil {
+		t.Error("cleared without a heartbeat")
+	}
+
+	// A heartbeat does not clear the latch, it only allows clearing it
+	e.heartbeat()
+	expectStopped(t, e, driveCommand{autonomous: true}, true)
+	if err := e.clear("test"); err != nil {
+		t.Fatal(err)
+	}
+	expectStopped(t, e, driveCommand{autonomous: true}, false)
+
+	// Disabling the dead-man does not trip it
+	e.setDeadman(0)
+	e.lastHeartbeat = time.Now().Add(-time.Hour)
+	expectStopped(t, e, driveCommand{autonomous: true}, false)
+}
+
+func TestOverrideDecision(t *testing.T) {
+	manual := driveCommand{steering: -0.5, throttle: 0.3}
+	if steering, throttle, mode, overrides := overrideDecision(manual, false); !overrides || steering != -0.5 || throttle != 0.3 || mode != "manual" {
+		t.Errorf("manual: %f, %f (%s, %v)", steering, throttle, mode, overrides)
+	}
+	if _, _, _, overrides := overrideDecision(driveCommand{autonomous: true}, false); overrides {
+		t.Error("overrides the steering controller in autonomous mode")
+	}
+}
+
+func TestEstopApi(t *testing.T) {
+	serviceEstop := estop
+	estop = &emergencyStop{lastHeartbeat: time.Now()}
+	defer func() { estop = serviceEstop }()
+	estop.setDeadman(time.Hour)
+	mux := http.NewServeMux()
+	registerEstopApi(mux)
+
+	request := func(method string, path string, wantStatus int) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		if recorder.Code != wantStatus {
+			t.Fatalf("%s %s: status %d, want %d: %s", method, path, recorder.Code, wantStatus, recorder.Body)
+		}
+	}
+
+	request(http.MethodPost, "/api/estop", http.StatusOK)
+	expectStopped(t, estop, driveCommand{autonomous: true}, true)
+	request(http.MethodPost, "/api/estop/heartbeat", http.StatusOK)
+	request(http.MethodGet, "/api/estop", http.StatusOK)
+	expectStopped(t, estop, driveCommand{autonomous: true}, true)
+
+	// Refused while the heartbeat is missing
+	estop.lastHeartbeat = time.Now().Add(-2 * time.Hour)
+	request(http.MethodDelete, "/api/estop", http.StatusConflict)
+	expectStopped(t, estop, driveCommand{autonomous: true}, true)
+
+	request(http.MethodPost, "/api/estop/heartbeat", http.StatusOK)
+	request(http.MethodDelete, "/api/estop", http.StatusOK)
+	expectStopped(t, estop, driveCommand{autonomous: true}, false)
+
+	request(http.MethodPut, "/api/estop", http.StatusMethodNotAllowed)
+	request(http.MethodGet, "/api/estop/heartbeat", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The imaging module appends values that are not (yet) part of the communication definitions to the
+// SensorOutput, as a nested message with a field number far outside the range used by the definitions.
+// proto.Unmarshal keeps it as an unknown field.
+//
+//	1000 frame extension
+//	  1  monotonic time (ns) before reading the frame
+//	  2  monotonic time (ns) the frame was read from the camera
+//	  3  repeated stage: 1 name, 2 monotonic time (ns) the stage ended
+//	  4  sequence number of the message on the path output, starts at 1
+//	  5  session, a random number picked when the imaging module starts
+//	  6  lateral offset of the lane, -1 and 1 are the image edges (float), only when a lane was found
+//	  7  heading of the lane in radians (float), only when a lane was found
+//	  8  width of the lane in pixels, only when a lane was found
+//	  9  confidence of the detection in [0,1] (float), only when a lane was found
+//	 10  distance of the obstacle on the lane as a fraction of the image height (float), only with flagObstacle
+//
+// Keep this in sync with the imaging module's extension.go.
+const frameExtensionField = 1000
+
+// The controller echoes the frame a decision responds to in the same field of its decisions, so that recordings and
+// the replay tool can pair every decision with its frame even when frames were skipped or arrived late.
+//
+//	1000 decision extension
+//	  4  sequence number of the imaging frame
+//	  5  session of the imaging module
+//
+// Decisions that do not respond to a frame (manual driving, stops without a frame) have no decision extension.
+
+// The imaging frame a decision responds to
+type frameRef struct {
+	session  uint64
+	sequence uint64 // 0 if the decision does not respond to a numbered frame
+}
+
+// Returns the reference to the frame of a parsed frame extension, the zero frameRef without one
+func refOf(ext frameExtension, hasExt bool) frameRef {
+	if !hasExt {
+		return frameRef{}
+	}
+	return frameRef{session: ext.session, sequence: ext.sequence}
+}
+
+func appendDecisionExtension(b []byte, frame frameRef) []byte {
+	size := protowire.SizeTag(4) + protowire.SizeVarint(frame.sequence) + protowire.SizeTag(5) + protowire.SizeFixed64()
+	b = protowire.AppendTag(b, frameExtensionField, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(size))
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, frame.sequence)
+	b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, frame.session)
+	return b
+}
+
+// Set in the Flags of the CameraSensorOutput while the imaging module's camera does not deliver frames, the message
+// then has no trajectory points. Keep this in sync with the imaging module's camera.go.
+const flagCameraUnhealthy = uint32(1 << 0)
+
+// A processing stage of a frame and the monotonic time (ns) it ended
+type stageTime struct {
+	name string
+	end  int64
+}
+
+type frameExtension struct {
+	start         int64
+	capture       int64
+	stages        []stageTime
+	sequence      uint64 // 0 if the imaging module does not send sequence numbers
+	session       uint64
+	lane          laneGeometry
+	hasLane       bool // false if the imaging module found no lane or does not measure it
+	confidence    float32
+	hasConfidence bool // false if the imaging module does not score its detection
+	obstacle      float32
+	hasObstacle   bool
+}
+
+// The lane as measured by the imaging module, independent of its resolution
+type laneGeometry struct {
+	offset  float32 // lateral offset of the lane center from the image center, -1 is the left edge and 1 the right edge, beyond that for a lane inferred from one edge
+	heading float32 // angle of the lane in the image in radians, positive bends to the right
+	width   uint32  // width of the lane in the lookahead row in pixels
+}
+
+// Reads the frame extension from a received SensorOutput, returns false if the imaging module did not send one
+func readFrameExtension(output *pb_outputs.SensorOutput) (frameExtension, bool, error) {
+	ext := frameExtension{}
+	found := false
+	b := output.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ext, false, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == frameExtensionField && typ == protowire.BytesType {
+			m, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return ext, false, protowire.ParseError(n)
+			}
+			err := parseFrameExtension(m, &ext)
+			if err != nil {
+				return ext, false, err
+			}
+			found = true
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return ext, false, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return ext, found, nil
+}
+
+func parseFrameExtension(b []byte, ext *frameExtension) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.start = int64(v)
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.capture = int64(v)
+			b = b[n:]
+		case num == 3 && typ == protowire.BytesType:
+			m, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			stage, err := parseStageTime(m)
+			if err != nil {
+				return err
+			}
+			ext.stages = append(ext.stages, stage)
+			b = b[n:]
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.sequence = v
+			b = b[n:]
+		case num == 5 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.session = v
+			b = b[n:]
+		case num == 6 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.lane.offset = math.Float32frombits(v)
+			ext.hasLane = true
+			b = b[n:]
+		case num == 7 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.lane.heading = math.Float32frombits(v)
+			b = b[n:]
+		case num == 8 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.lane.width = uint32(v)
+			b = b[n:]
+		case num == 9 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.confidence = math.Float32frombits(v)
+			ext.hasConfidence = true
+			b = b[n:]
+		case num == 10 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ext.obstacle = math.Float32frombits(v)
+			ext.hasObstacle = true
+			b = b[n:]
+		default:
+			// Written by a newer imaging module, skip it
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func parseStageTime(b []byte) (stageTime, error) {
+	stage := stageTime{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return stage, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return stage, protowire.ParseError(n)
+			}
+			stage.name = v
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return stage, protowire.ParseError(n)
+			}
+			stage.end = int64(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return stage, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	if stage.name == "" {
+		return stage, fmt.Errorf("frame extension has a stage without a name")
+	}
+	return stage, nil
+}
+
+// Monotonic clock in nanoseconds, the same clock the imaging module uses for its timestamps
+func monotonicNow() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecisionExtension(t *testing.T) {
+	frame := frameRef{session: 0xdeadbeef, sequence: 300}
+	b := appendDecisionExtension(nil, frame)
+
+	num, typ, n := protowire.ConsumeTag(b)
+	if n < 0 || num != frameExtensionField || typ != protowire.BytesType {
+		t.Fatalf("decision extension starts with field %d of type %d", num, typ)
+	}
+	m, n := protowire.ConsumeBytes(b[n:])
+	if n < 0 {
+		t.Fatal(protowire.ParseError(n))
+	}
+	// Read back with the frame extension parser, the numbering is shared
+	ext := frameExtension{}
+	if err := parseFrameExtension(m, &ext); err != nil {
+		t.Fatal(err)
+	}
+	if got := refOf(ext, true); got != frame {
+		t.Errorf("got %+v, want %+v", got, frame)
+	}
+	if got := refOf(ext, false); got != (frameRef{}) {
+		t.Errorf("got %+v without an extension, want the zero frameRef", got)
+	}
+}
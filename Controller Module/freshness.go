@@ -0,0 +1,104 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Receives every message that is queued on the socket and returns only the newest one, so the controller never
+// steers on a frame that waited behind newer ones. Returns the number of messages that were skipped.
+// Call this after polling, it does not block.
+func receiveLatest(sock *zmq.Socket) ([]byte, int, error) {
+	var latest []byte
+	skipped := 0
+	for {
+		message, err := sock.RecvBytes(zmq.DONTWAIT)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN) {
+				// Nothing queued anymore
+				break
+			}
+			return nil, skipped, err
+		}
+		if latest != nil {
+			skipped++
+		}
+		latest = message
+	}
+	return latest, skipped, nil
+}
+
+// Estimates how many frames the imaging module published that never arrived, from the gaps between the
+// frame timestamps. The frame interval is learned from the timestamps, so it follows the camera frame rate.
+type frameGapDetector struct {
+	last     time.Time     // capture time of the previous frame
+	interval time.Duration // typical interval between frames, smoothed over a few frames
+}
+
+// Registers the capture time of a received frame and returns the number of frames that were missed before it.
+// skipped is the number of frames that did arrive but were skipped by receiveLatest, those are not missed.
+func (d *frameGapDetector) observe(captured time.Time, skipped int) int {
+	if d.last.IsZero() {
+		d.last = captured
+		return 0
+	}
+	gap := captured.Sub(d.last)
+	if gap <= 0 {
+		// Out of order or the same millisecond, nothing to learn from
+		return 0
+	}
+	d.last = captured
+	if d.interval == 0 {
+		d.interval = gap
+		return 0
+	}
+
+	missed := 0
+	if gap > d.interval*3/2 {
+		missed = max(int((gap+d.interval/2)/d.interval)-1-skipped, 0)
+	} else {
+		// Only learn from regular intervals, so a burst of missed frames does not skew the estimate
+		d.interval = (d.interval*9 + gap) / 10
+	}
+	return missed
+}
+
+// Forgets the previous frame, call this when frames are ignored on purpose (e.g. during a stop)
+func (d *frameGapDetector) reset() {
+	d.last = time.Time{}
+}
+
+// Age of a frame when it is about to be used. The monotonic capture time of the frame extension is preferred,
+// the millisecond timestamp is used for imaging modules that do not send the extension.
+func frameAge(timestamp uint64, ext frameExtension, hasExt bool) time.Duration {
+	if hasExt && ext.capture > 0 {
+		return time.Duration(monotonicNow() - ext.capture)
+	}
+	return time.Since(time.UnixMilli(int64(timestamp)))
+}
+
+// Stops the rover when no frame was steered on for too long, e.g. when the imaging module hangs or the link breaks.
+// The actuator keeps driving on the last decision until it receives a new one.
+type frameWatchdog struct {
+	timeout time.Duration // 0 disables the watchdog
+	last    time.Time     // when the last frame was steered on
+	starved bool          // whether the timeout passed since
+}
+
+// Registers a frame that was steered on, or a moment from which to wait for frames again (e.g. after a stop)
+func (w *frameWatchdog) feed(now time.Time) {
+	w.last = now
+	w.starved = false
+}
+
+// Returns whether no frame was steered on for longer than the timeout, and whether that is new since the last check
+func (w *frameWatchdog) check(now time.Time) (starved bool, first bool) {
+	if w.timeout <= 0 || now.Sub(w.last) <= w.timeout {
+		return false, false
+	}
+	first = !w.starved
+	w.starved = true
+	return true, first
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameWatchdog(t *testing.T) {
+	start := time.Now()
+	w := frameWatchdog{timeout: 200 * time.Millisecond}
+	w.feed(start)
+
+	steps := []struct {
+		after   time.Duration // since start
+		feed    bool          // a frame was steered on at this moment
+		starved bool
+		first   bool
+	}{
+		{after: 50 * time.Millisecond},
+		{after: 200 * time.Millisecond},
+		// No frames for longer than the timeout, the stop is repeated until they arrive
+		{after: 250 * time.Millisecond, starved: true, first: true},
+		{after: 300 * time.Millisecond, starved: true},
+		{after: 1000 * time.Millisecond, starved: true},
+		{after: 1050 * time.Millisecond, feed: true},
+		{after: 1100 * time.Millisecond},
+		{after: 1300 * time.Millisecond, starved: true, first: true},
+	}
+	for _, step := range steps {
+		now := start.Add(step.after)
+		if step.feed {
+			w.feed(now)
+		}
+		starved, first := w.check(now)
+		if starved != step.starved || first != step.first {
+			t.Errorf("after %v: starved %v first %v, want %v %v", step.after, starved, first, step.starved, step.first)
+		}
+	}
+}
+
+func TestFrameWatchdogDisabled(t *testing.T) {
+	w := frameWatchdog{}
+	w.feed(time.Now())
+	if starved, _ := w.check(time.Now().Add(time.Hour)); starved {
+		t.Error("starved with a zero timeout, want the watchdog disabled")
+	}
+}
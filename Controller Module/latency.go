@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Latency of every stage from camera capture to the decision, based on the stage timestamps in the frame extension
+//
+//   GET    /api/latency   per-stage and end-to-end histograms as json
+//   DELETE /api/latency   start counting from scratch
+//
+// The imaging stages (read, threshold, morphology, ...) are followed by the controller's own:
+// transit (ZMQ from imaging to the controller), control (parsing and the steering update) and
+// publish (marshalling and sending the decision). End-to-end runs from the capture to the decision.
+
+// Upper bounds of the histogram buckets in milliseconds, the last bucket has no upper bound
+var latencyBuckets = []float64{0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// Frames with a larger end-to-end latency are not counted, they were recorded earlier (replay) or the clocks do not match
+const maxLatency = 10 * time.Second
+
+// How often the latencies are logged
+const latencyLogInterval = 10 * time.Second
+
+type latencyHistogram struct {
+	Counts []uint64 `json:"counts"` // per bucket, see latencyBuckets
+	Count  uint64   `json:"count"`
+	Sum    float64  `json:"sum-ms"`
+	Max    float64  `json:"max-ms"`
+}
+
+// Approximates the quantile with the upper bound of the bucket it is in
+func (h *latencyHistogram) quantile(q float64) float64 {
+	target := uint64(q * float64(h.Count))
+	cumulative := uint64(0)
+	for i, count := range h.Counts {
+		cumulative += count
+		if cumulative > target && i < len(latencyBuckets) {
+			return min(latencyBuckets[i], h.Max)
+		}
+	}
+	return h.Max
+}
+
+type latencySummary struct {
+	Stage   string           `json:"stage"`
+	Mean    float64          `json:"mean-ms"`
+	P50     float64          `json:"p50-ms"`
+	P95     float64          `json:"p95-ms"`
+	P99     float64          `json:"p99-ms"`
+	Buckets []float64        `json:"buckets-ms"`
+	Latency latencyHistogram `json:"histogram"`
+}
+
+type latencyStats struct {
+	lock   sync.Mutex
+	order  []string // stages in the order they were first seen, which is the order of the pipeline
+	stages map[string]*latencyHistogram
+}
+
+// Global, filled by the main loop and read by the api and the logger
+var latencies = &latencyStats{stages: map[string]*latencyHistogram{}}
+
+// Counts the stages of a frame, received, controlled and published are the controller's monotonic timestamps.
+// Returns false if the frame was not counted.
+func (l *latencyStats) observeFrame(ext frameExtension, received, controlled, published int64) bool {
+	endToEnd := time.Duration(published - ext.capture)
+	if ext.capture == 0 || len(ext.stages) == 0 || endToEnd < 0 || endToEnd > maxLatency {
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	previous := ext.start
+	for _, stage := range ext.stages {
+		l.observe(stage.name, time.Duration(stage.end-previous))
+		previous = stage.end
+	}
+	l.observe("transit", time.Duration(received-previous))
+	l.observe("control", time.Duration(controlled-received))
+	l.observe("publish", time.Duration(published-controlled))
+	l.observe("end-to-end", endToEnd)
+	return true
+}
+
+// Must be called with the lock held
+func (l *latencyStats) observe(stage string, latency time.Duration) {
+	h, ok := l.stages[stage]
+	if !ok {
+		h = &latencyHistogram{Counts: make([]uint64, len(latencyBuckets)+1)}
+		l.stages[stage] = h
+		l.order = append(l.order, stage)
+	}
+	ms := max(float64(latency)/float64(time.Millisecond), 0)
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.Counts[bucket]++
+	h.Count++
+	h.Sum += ms
+	h.Max = max(h.Max, ms)
+}
+
+func (l *latencyStats) summary() []latencySummary {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	summary := make([]latencySummary, 0, len(l.order))
+	for _, stage := range l.order {
+		h := l.stages[stage]
+		s := latencySummary{
+			Stage:   stage,
+			P50:     h.quantile(0.5),
+			P95:     h.quantile(0.95),
+			P99:     h.quantile(0.99),
+			Buckets: latencyBuckets,
+			Latency: *h,
+		}
+		s.Latency.Counts = append([]uint64{}, h.Counts...)
+		if h.Count > 0 {
+			s.Mean = h.Sum / float64(h.Count)
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+func (l *latencyStats) reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.order = nil
+	l.stages = map[string]*latencyHistogram{}
+}
+
+// Logs the latencies every interval, should be run as a goroutine
+func (l *latencyStats) logPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, s := range l.summary() {
+			log.Info().
+				Str("stage", s.Stage).
+				Uint64("count", s.Latency.Count).
+				Float64("mean-ms", s.Mean).
+				Float64("p50-ms", s.P50).
+				Float64("p95-ms", s.P95).
+				Float64("max-ms", s.Latency.Max).
+				Msg("Latency")
+		}
+	}
+}
+
+func registerLatencyApi(mux *http.ServeMux) {
+	mux.HandleFunc("/api/latency", serveLatency)
+}
+
+func serveLatency(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, latencies.summary())
+	case http.MethodDelete:
+		latencies.reset()
+		writeJson(w, latencies.summary())
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
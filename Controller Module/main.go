@@ -3,6 +3,8 @@ package main
 import (
 	"time"
 	"fmt"
+	"net/http"
+	"syscall"
 
 	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
 	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
@@ -19,6 +21,10 @@ func run(
 	service servicerunner.ResolvedService,
 	sysMan servicerunner.SystemManagerInfo,
 	initialTuning *pb_systemmanager_messages.TuningState) error {
+	// Runs last, after the sockets and the keyboard are closed (see onTerminate)
+	defer close(stopped)
+	// Stops the keyboard goroutine when run returns with an error
+	defer stop()
 
 	// Get the address of trajectory data output by the imaging module
 	imagingTrajectoryAddress, err := service.GetDependencyAddress("imaging", "path")
@@ -37,6 +43,12 @@ func run(
 	if err != nil {
 		return err
 	}
+	defer outputSock.Close()
+	// Give the final decision some time to get out when the socket is closed
+	err = outputSock.SetLinger(finalDecisionLinger)
+	if err != nil {
+		return err
+	}
 	err = outputSock.Bind(decisionAddress)
 	if err != nil {
 		return err
@@ -47,6 +59,11 @@ func run(
 	if err != nil {
 		return err
 	}
+	defer imagingSock.Close()
+	err = imagingSock.SetLinger(0)
+	if err != nil {
+		return err
+	}
 	err = imagingSock.Connect(imagingTrajectoryAddress)
 	if err != nil {
 		return err
@@ -71,18 +88,56 @@ func run(
 	}
 
 	// Get speed to use
-	/*speed1, err := servicerunner.GetTuningFloat("speed", initialTuning)
+	speed, err := servicerunner.GetTuningFloat("speed", initialTuning)
+	if err != nil {
+		return err
+	}
+
+	// Get the desired trajectory point, as a fraction of the image width. Older configurations have the
+	// desired-trajectory-point in pixels instead, applyTuning converts it.
+	var desiredTrajectoryFraction *float32
+	var desiredTrajectoryPoint *int
+	if fraction, err := servicerunner.GetTuningFloat("desired-trajectory-fraction", initialTuning); err == nil {
+		desiredTrajectoryFraction = &fraction
+	} else if point, pointErr := servicerunner.GetTuningInt("desired-trajectory-point", initialTuning); pointErr == nil {
+		desiredTrajectoryPoint = &point
+	} else {
+		return err
+	}
+
+	// Get the steering controller to use (pid or mpc)
+	controllerMode, err := servicerunner.GetTuningString("controller", initialTuning)
+	if err != nil {
+		return err
+	}
+
+	// Get what the PID controller regulates (pixel or normalized) and the weight of the lane heading
+	errorMode, err := servicerunner.GetTuningString("error-mode", initialTuning)
 	if err != nil {
 		return err
-	}*/
+	}
+	headingGain, err := servicerunner.GetTuningFloat("heading-gain", initialTuning)
+	if err != nil {
+		return err
+	}
 
-	// Get the desired trajectory point
-	desiredTrajectoryPoint, err := servicerunner.GetTuningInt("desired-trajectory-point", initialTuning)
+	// From here on the tuning can be changed by the system manager, the tuning API and the keyboard
+	_, err = applyTuning(tuningUpdate{
+		Kp:                        &kp,
+		Ki:                        &ki,
+		Kd:                        &kd,
+		Speed:                     &speed,
+		DesiredTrajectoryFraction: desiredTrajectoryFraction,
+		DesiredTrajectoryPoint:    desiredTrajectoryPoint,
+		Mode:                      &controllerMode,
+		ErrorMode:                 &errorMode,
+		HeadingGain:               &headingGain,
+	}, "service.yaml")
 	if err != nil {
 		return err
 	}
 
-	// Initialize pid controller
+	// Initialize pid controller, the gains are updated from the tuning every frame
 	pidController := pid.Controller{
 		Config: pid.ControllerConfig{
 			ProportionalGain: float64(kp),
@@ -91,76 +146,214 @@ func run(
 		},
 	}
 
-	err = keyboard.Open()
+	// Initialize the steering controllers, so the mode can be switched while driving
+	mpcOptions, err := getMpcConfig(initialTuning)
 	if err != nil {
 		return err
 	}
+	pidSteer := &pidSteering{controller: &pidController, errorMode: errorMode}
+	steeringControllers := map[string]steeringController{
+		"pid": pidSteer,
+		"mpc": newMpcSteering(mpcOptions),
+	}
+	log.Info().Str("controller", controllerMode).Msg("Using steering controller")
 
-	speed := float32(0.2)
-	speedIncrement := float32(0.05)
-	kpIncrement := float32(0.00005)
-	kdIncrement := float32(0.0001)
+	// Serve the dashboard and the tuning API, so the loop can be watched and tuned from a laptop on the rover's network
+	httpAddress, err := servicerunner.GetTuningString("http-address", initialTuning)
+	if err != nil {
+		return err
+	}
+	liveDashboard := newDashboard()
+	if httpAddress != "" {
+		mux := http.NewServeMux()
+		liveDashboard.register(mux)
+		registerTuningApi(mux)
+		registerEstopApi(mux)
+		registerLatencyApi(mux)
+		registerMetrics(mux)
+		go func() {
+			err := http.ListenAndServe(httpAddress, mux)
+			log.Err(err).Str("address", httpAddress).Msg("Dashboard server stopped")
+		}()
+		log.Info().Str("address", httpAddress).Msg("Serving dashboard, tuning and emergency stop API and metrics")
+	}
 
-	go func() { //go routine for keyboard input
-		defer keyboard.Close()
-		for {
-			char, key, err := keyboard.GetKey()
-			char ++
-			if err!= nil {
-				log.Err(err).Msg("Error getting key press")
-				continue
-			}
-			if key==keyboard.KeyArrowUp {
-				speed += speedIncrement
-				if speed > 0.5 {
-					speed = 0.5
-				}
-				fmt.Println("Speed increased to:", speed)
-			} else if key==keyboard.KeyArrowDown {
-				speed -= speedIncrement
-				if speed < 0 {
-					speed = 0
-				}
-				fmt.Println("Speed decreased to:", speed)
-			} else if key == keyboard.KeyEsc {
-				break							
-			} else if key == keyboard.KeyCtrlA{ //increase kp
-				kp += kpIncrement
-				if kp > 1 {
-					kp = 1
-				}
-				fmt.Println("kp increased to:", kp) 
-			} else if key == keyboard.KeyCtrlS { // decrease kp
-				kp -= kpIncrement
-				if kp < 0 {
-					kp = 0
-				}
-				fmt.Println("kp decreased to:", kp)
-			} else if key == keyboard.KeyCtrlD { // increase kd
-				kd += kdIncrement
-				if kd > 1 {
-					kd = 1
-				}
-				fmt.Println("kd increased to:", kd) 
-			} else if key == keyboard.KeyCtrlH{ // decrease kd
-				kd -= kdIncrement
-				if kd < 0 {
-					kd = 0
-				}
-				fmt.Println("kd decreased to:", kd)
-			}
+	// The dead-man stops the rover when the operator's heartbeats (POST /api/estop/heartbeat) go quiet
+	deadmanTimeout, err := servicerunner.GetTuningInt("deadman-timeout-ms", initialTuning)
+	if err != nil {
+		return err
+	}
+	if deadmanTimeout > 0 {
+		if httpAddress == "" {
+			return fmt.Errorf("the dead-man needs the http server for its heartbeats, set http-address or disable deadman-timeout-ms")
+		}
+		estop.setDeadman(time.Duration(deadmanTimeout) * time.Millisecond)
+		log.Info().Int("timeout-ms", deadmanTimeout).Msg("Dead-man enabled, waiting for heartbeats")
+	}
 
-			time.Sleep(time.Millisecond * 100) // this should delay high CPU usage in case
+	// Keyboard teleop is optional, it needs an interactive terminal which the rover usually does not have
+	keyboardEnabled, err := servicerunner.GetTuningInt("keyboard", initialTuning)
+	if err != nil {
+		return err
+	}
+	if keyboardEnabled != 0 {
+		err = keyboard.Open()
+		if err != nil {
+			return err
 		}
-	}()
+		defer closeKeyboard()
+		go runKeyboard()
+		log.Info().Msg("Keyboard teleop enabled, press m to toggle manual control and space to stop")
+	}
+
+	// Frames older than this are not steered on, the rover would react to where the lane was
+	maxFrameAgeMs, err := servicerunner.GetTuningInt("max-frame-age-ms", initialTuning)
+	if err != nil {
+		return err
+	}
+	maxFrameAge := time.Duration(maxFrameAgeMs) * time.Millisecond
+
+	// Frames the imaging module is not confident about are not steered on, or slow the rover down
+	minConfidence, err := servicerunner.GetTuningFloat("min-confidence", initialTuning)
+	if err != nil {
+		return err
+	}
+	slowdownConfidence, err := servicerunner.GetTuningFloat("slowdown-confidence", initialTuning)
+	if err != nil {
+		return err
+	}
+	gate := confidenceGate{minimum: float64(minConfidence), slowdown: float64(slowdownConfidence)}
+
+	// Obstacles the imaging module sees on the lane slow the rover down and stop it
+	obstacleSlowdown, err := servicerunner.GetTuningFloat("obstacle-slowdown-distance", initialTuning)
+	if err != nil {
+		return err
+	}
+	obstacleStop, err := servicerunner.GetTuningFloat("obstacle-stop-distance", initialTuning)
+	if err != nil {
+		return err
+	}
+	brake, err := newObstacleBrake(float64(obstacleSlowdown), float64(obstacleStop), mpcOptions.viewDepth)
+	if err != nil {
+		return err
+	}
+	gaps := frameGapDetector{}
+	sequences := sequenceTracker{}
+	// Frames that are too old are not steered on, so no frames for as long means the rover drives blind
+	frames := frameWatchdog{timeout: maxFrameAge}
+	frames.feed(time.Now())
+
+	go latencies.logPeriodically(latencyLogInterval)
+
+	activeMode := controllerMode
+	// Frame rate of the loop, smoothed over a few frames
+	fps := 0.0
+	lastFrame := time.Now()
+
+	// Poll with a timeout, so manual and stop decisions are also sent when no frames arrive
+	poller := zmq.NewPoller()
+	poller.Add(imagingSock, zmq.POLLIN)
+	overridden := false
+	cameraUnhealthy := false
+	obstacleStopped := false
 
 	// Main loop, subscribe to trajectory data and send decision data
 	for {
-		// Receive trajectory data
-		sensorBytes, err := imagingSock.RecvBytes(0)
+		if isStopping() {
+			// Do not leave the rover driving on the last decision
+			err = publishDecision(outputSock, 0, 0, frameRef{})
+			if err != nil {
+				log.Err(err).Msg("Failed to send the final controller output")
+			}
+			log.Info().Msg("Sent the final zero throttle decision")
+			return nil
+		}
+
+		polled, err := poller.Poll(manualDecisionInterval)
+		if zmq.AsErrno(err) == zmq.Errno(syscall.EINTR) {
+			// Interrupted by a signal, check if the service is terminated
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		var sensorBytes []byte
+		received := int64(0)
+		skipped := 0
+		if len(polled) > 0 {
+			// Receive trajectory data, frames that queued up while the loop was busy are skipped for the newest one
+			sensorBytes, skipped, err = receiveLatest(imagingSock)
+			if err != nil {
+				return err
+			}
+			received = monotonicNow()
+			if skipped > 0 {
+				log.Debug().Int("skipped", skipped).Msg("Skipped queued imaging frames")
+				framesSkipped.add(float64(skipped))
+			}
+		}
+
+		// The emergency stop and the operator override the steering controller, frames that arrive in the meantime are dropped
+		command := currentDrive()
+		estopped := estop.stopped()
+		stoppedGauge.set(boolMetric(estopped))
+		autonomousGauge.set(boolMetric(command.autonomous))
+		if steerValue, throttle, mode, overrides := overrideDecision(command, estopped); overrides {
+			liveDashboard.publish(telemetry{
+				Time:       time.Now().UnixMilli(),
+				Controller: mode,
+				Steering:   float64(steerValue),
+				Throttle:   float64(throttle),
+				Fps:        fps,
+				Watchdog:   "ok",
+			})
+			steeringValue.set(float64(steerValue))
+			throttleValue.set(float64(throttle))
+			if sensorBytes != nil {
+				framesDropped.inc()
+			}
+			err = publishDecision(outputSock, steerValue, throttle, frameRef{})
+			if err != nil {
+				log.Err(err).Msg("Failed to send controller output")
+			}
+			overridden = true
+			// The frames dropped here are not missed
+			gaps.reset()
+			sequences.resync()
+			frames.feed(time.Now())
+			continue
+		}
+		if overridden {
+			// Do not continue from the state from before the override
+			steeringControllers[activeMode].Reset()
+			gate.reset()
+			overridden = false
+		}
+		// Stop when no frame was steered on for too long, with or without frames arriving (e.g. only stale ones)
+		if starved, first := frames.check(time.Now()); starved {
+			if first {
+				log.Warn().Dur("timeout", maxFrameAge).Msg("No imaging frames to steer on, stopping until they arrive")
+				framesTimedOut.inc()
+			}
+			liveDashboard.publish(telemetry{
+				Time:       time.Now().UnixMilli(),
+				Controller: activeMode,
+				Fps:        fps,
+				Watchdog:   "lost",
+			})
+			steeringValue.set(0)
+			throttleValue.set(0)
+			err = publishDecision(outputSock, 0, 0, frameRef{})
+			if err != nil {
+				log.Err(err).Msg("Failed to send controller output")
+			}
+			// Start from a clean state once frames arrive again
+			steeringControllers[activeMode].Reset()
+			gate.reset()
+		}
+		if sensorBytes == nil {
+			continue
+		}
 
 		log.Debug().Msg("Received imaging data")
 
@@ -169,6 +362,7 @@ func run(
 		err = proto.Unmarshal(sensorBytes, sensorOutput)
 		if err != nil {
 			log.Err(err).Msg("Failed to unmarshal trajectory data")
+			framesDropped.inc()
 			continue
 		}
 
@@ -176,85 +370,264 @@ func run(
 		imagingData := sensorOutput.GetCameraOutput()
 		if imagingData == nil {
 			log.Warn().Msg("Received sensor data that was not camera data")
+			framesDropped.inc()
 			continue
 		}
 
+		// Stage timestamps of the imaging module, for the latency histograms
+		frameTimes, hasFrameTimes, err := readFrameExtension(sensorOutput)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to read frame extension")
+		}
+
+		// Count the frames that never arrived, from the sequence numbers or (for older imaging modules) the timestamps.
+		// The camera health messages below are numbered as well, they are tracked so they do not count as lost afterwards.
+		if hasFrameTimes && frameTimes.sequence > 0 {
+			if !sequences.accept(frameTimes.session, frameTimes.sequence, skipped, steeringControllers[activeMode]) {
+				framesDropped.inc()
+				continue
+			}
+		} else if missed := gaps.observe(time.UnixMilli(int64(sensorOutput.Timestamp)), skipped); missed > 0 {
+			log.Debug().Int("missed", missed).Msg("Imaging frames missed")
+			framesMissed.add(float64(missed))
+		}
+
+		// The imaging module flags when its camera does not deliver frames, do not drive blind
+		if imagingData.GetFlags()&flagCameraUnhealthy != 0 {
+			if !cameraUnhealthy {
+				log.Error().Msg("Imaging reports an unhealthy camera, stopping until it recovers")
+				cameraUnhealthy = true
+			}
+			cameraGauge.set(1)
+			liveDashboard.publish(telemetry{
+				Time:       time.Now().UnixMilli(),
+				Controller: activeMode,
+				Fps:        fps,
+				Watchdog:   "camera",
+			})
+			steeringValue.set(0)
+			throttleValue.set(0)
+			err = publishDecision(outputSock, 0, 0, refOf(frameTimes, hasFrameTimes))
+			if err != nil {
+				log.Err(err).Msg("Failed to send controller output")
+			}
+			// Start from a clean state once frames arrive again
+			steeringControllers[activeMode].Reset()
+			gate.reset()
+			// The stop is sent for these, the watchdog would only change the reason on the dashboard
+			frames.feed(time.Now())
+			continue
+		}
+		if cameraUnhealthy {
+			log.Info().Msg("Imaging camera recovered")
+			cameraUnhealthy = false
+			cameraGauge.set(0)
+		}
+
 		// Get trajectory
 		trajectory := imagingData.GetTrajectory()
 		if trajectory == nil {
 			log.Warn().Msg("Received sensor data that was not trajectory data")
+			framesDropped.inc()
 			continue
 		}
 
+		// Do not steer on frames that are too old
+		age := frameAge(sensorOutput.Timestamp, frameTimes, hasFrameTimes)
+		frameAgeGauge.set(age.Seconds())
+		if maxFrameAge > 0 && age > maxFrameAge {
+			log.Warn().Dur("age", age).Dur("max", maxFrameAge).Msg("Rejected stale imaging frame")
+			framesStale.inc()
+			framesDropped.inc()
+			continue
+		}
+		frames.feed(time.Now())
+
+		// Checked before the trajectory, so a frame without trajectory points does not skip the brake
+		watchdog := "ok"
+		obstacleFactor := 1.0
+		if imagingData.GetFlags()&flagObstacle != 0 {
+			// Without a distance the obstacle is right in front of the rover
+			meters := 0.0
+			if frameTimes.hasObstacle {
+				meters = brake.meters(frameTimes.obstacle)
+			}
+			obstacleGauge.set(meters)
+			factor := brake.speedFactor(meters)
+			switch {
+			case factor == 0 && !obstacleStopped:
+				log.Warn().Float64("meters", meters).Msg("Obstacle ahead, stopping")
+			case factor > 0 && factor < 1:
+				log.Debug().Float64("meters", meters).Float64("factor", factor).Msg("Obstacle ahead, slowing down")
+			}
+			obstacleStopped = factor == 0
+			if obstacleStopped {
+				watchdog = "obstacle"
+			}
+			obstacleFactor = factor
+		} else {
+			obstacleGauge.set(-1)
+			obstacleStopped = false
+		}
+
 		// Get the first trajectory point
 		trajectoryPoints := trajectory.GetPoints()
 		if len(trajectoryPoints) == 0 {
-			log.Warn().Msg("Received sensor data that had no trajectory points")
+			// The lane is lost, do not keep driving on the previous decision
+			log.Warn().Msg("Received sensor data that had no trajectory points, stopping")
+			laneLost.inc()
+			framesDropped.inc()
+			if watchdog == "ok" {
+				watchdog = "lost"
+			}
+			liveDashboard.publish(telemetry{
+				Time:       time.Now().UnixMilli(),
+				Controller: activeMode,
+				Fps:        fps,
+				Watchdog:   watchdog,
+			})
+			steeringValue.set(0)
+			throttleValue.set(0)
+			err = publishDecision(outputSock, 0, 0, refOf(frameTimes, hasFrameTimes))
+			if err != nil {
+				log.Err(err).Msg("Failed to send controller output")
+			}
+			// Start from a clean state once the lane is found again
+			steeringControllers[activeMode].Reset()
+			gate.reset()
 			continue
 		}
 		firstPoint := trajectoryPoints[0]
+		lookaheadRow.set(float64(firstPoint.Y))
 		// This is the middle of the longest consecutive slice, it should be in the middle of the image (horizontally)
 
-		// Use the PID controller to decide where to go
-		//fmt.Println("Error: ", uint32(desiredTrajectoryPoint) - firstPoint.X)
-		fmt.Println("Error: ", desiredTrajectoryPoint, " and ", firstPoint.X)
-		pidController.Update(pid.ControllerInput{
-			ReferenceSignal:  float64(desiredTrajectoryPoint),
-			ActualSignal:     float64(firstPoint.X),
-			SamplingInterval: 100 * time.Millisecond,
-		})
-		steerValue := pidController.State.ControlSignal
-		log.Info().Float64("steerValue", steerValue).Int("Desired", desiredTrajectoryPoint).Float32("Actual", float32(firstPoint.X)).Msg("Calculated steering value")
-		log.Info().Float32("", speed).Msg("Current Speed")
-		log.Info().Float32("", kp).Msg("Current KP")
-		log.Info().Float32("", kd).Msg("Current KD")
+		// Pick up tuning changes
+		current := currentTuning()
+		pidController.Config.ProportionalGain = float64(current.Kp)
+		pidController.Config.IntegralGain = float64(current.Ki)
+		pidController.Config.DerivativeGain = float64(current.Kd)
+		pidSteer.headingGain = float64(current.HeadingGain)
+		if current.ErrorMode != pidSteer.errorMode {
+			// The integrator holds errors of the other unit
+			pidSteer.Reset()
+			pidSteer.errorMode = current.ErrorMode
+			log.Info().Str("error-mode", current.ErrorMode).Msg("Switched PID error mode")
+		}
+		steering := steeringControllers[current.Mode]
+		if current.Mode != activeMode {
+			// Start the new controller from a clean state
+			steering.Reset()
+			activeMode = current.Mode
+			log.Info().Str("controller", activeMode).Msg("Switched steering controller")
+		}
+		speed := current.Speed
+
+		// Use the steering controller to decide where to go, the setpoint follows the resolution of the imaging module
+		desiredX := float64(current.DesiredTrajectoryFraction) * trajectoryWidth(trajectory)
+		var lane *laneGeometry
+		if frameTimes.hasLane {
+			lane = &frameTimes.lane
+		}
+		confidence := 1.0
+		if frameTimes.hasConfidence {
+			confidence = float64(frameTimes.confidence)
+		}
+		confidenceGauge.set(confidence)
+		steerValue := 0.0
+		if gate.trusted(confidence) {
+			steerValue = steering.Update(trajectory, lane, desiredX, speed)
+		} else {
+			log.Debug().Float64("confidence", confidence).Msg("Low confidence frame, keeping the previous steering")
+			lowConfidence.inc()
+		}
+		log.Debug().Float64("steerValue", steerValue).Float64("Desired", desiredX).Float32("Actual", float32(firstPoint.X)).Msg("Calculated steering value")
+		log.Debug().Float32("speed", speed).Float32("kp", current.Kp).Float32("kd", current.Kd).Msg("Current tuning")
 		// min-max
 		if steerValue > 1 {
 			steerValue = 1
 		} else if steerValue < -1 {
 			steerValue = -1
 		}
+		steerValue, speed = gate.apply(confidence, steerValue, speed)
+		speed *= float32(obstacleFactor)
 		// todo! remove, actuator buggy
 		steerValue = -steerValue
+		controlled := monotonicNow()
 
-		// Create controller output, wrapped in generic sensor output
-		controllerOutput := &pb_outputs.SensorOutput{
-			SensorId:  1,
-			Timestamp: uint64(time.Now().UnixMilli()),
-			SensorOutput: &pb_outputs.SensorOutput_ControllerOutput{
-				ControllerOutput: &pb_outputs.ControllerOutput{
-					SteeringAngle: float32(steerValue),
-					LeftThrottle:  speed,
-					RightThrottle: speed,
-					FrontLights:   false,
-				},
-			},
-		}
-
-		// Marshal the controller output
-		controllerBytes, err := proto.Marshal(controllerOutput)
-		if err != nil {
-			log.Err(err).Msg("Failed to marshal controller output")
-			continue
+		now := time.Now()
+		if interval := now.Sub(lastFrame).Seconds(); interval > 0 {
+			fps = 0.9*fps + 0.1/interval
 		}
+		lastFrame = now
+		terms := steering.Terms()
+		liveDashboard.publish(telemetry{
+			Time:         now.UnixMilli(),
+			Controller:   activeMode,
+			Error:        terms.Error,
+			Proportional: terms.Proportional,
+			Integral:     terms.Integral,
+			Derivative:   terms.Derivative,
+			Steering:     steerValue,
+			Throttle:     float64(speed),
+			Fps:          fps,
+			Watchdog:     watchdog,
+		})
 
-		// Send it for the actuator (and others) to use
-		_, err = outputSock.SendBytes(controllerBytes, 0)
+		err = publishDecision(outputSock, float32(steerValue), speed, refOf(frameTimes, hasFrameTimes))
 		if err != nil {
 			log.Err(err).Msg("Failed to send controller output")
 			continue
 		}
+		if hasFrameTimes {
+			latencies.observeFrame(frameTimes, received, controlled, monotonicNow())
+		}
+		framesProcessed.inc()
+		steeringError.set(terms.Error)
+		steeringValue.set(steerValue)
+		throttleValue.set(float64(speed))
+		controllerFps.set(fps)
 
 		log.Debug().Msg("Sent controller output")
 	}
 }
 
+// Sends a steering and throttle decision for the actuator (and others) to use, frame is the imaging frame it responds to
+func publishDecision(outputSock *zmq.Socket, steering float32, throttle float32, frame frameRef) error {
+	// Create controller output, wrapped in generic sensor output
+	controllerOutput := &pb_outputs.SensorOutput{
+		SensorId:  1,
+		Timestamp: uint64(time.Now().UnixMilli()),
+		SensorOutput: &pb_outputs.SensorOutput_ControllerOutput{
+			ControllerOutput: &pb_outputs.ControllerOutput{
+				SteeringAngle: steering,
+				LeftThrottle:  throttle,
+				RightThrottle: throttle,
+				FrontLights:   false,
+			},
+		},
+	}
+	if frame.sequence > 0 {
+		controllerOutput.ProtoReflect().SetUnknown(appendDecisionExtension(nil, frame))
+	}
+
+	// Marshal the controller output
+	controllerBytes, err := proto.Marshal(controllerOutput)
+	if err != nil {
+		return err
+	}
+
+	_, err = outputSock.SendBytes(controllerBytes, 0)
+	return err
+}
+
 func onTuningState(newtuning *pb_systemmanager_messages.TuningState) {
 	log.Info().Str("Value", newtuning.String()).Msg("Received tuning state from system manager")
-	// shareddata.Tuning = newtuning
-	// pidController.Reset()
+	_, err := applyTuning(tuningUpdateFromState(newtuning), "system manager")
+	if err != nil {
+		log.Err(err).Msg("Rejected tuning state from system manager")
+	}
 }
 
 func main() {
-	servicerunner.Run(run, onTuningState, false)
+	servicerunner.Run(run, onTuningState, onTerminate, false)
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters and gauges served on /metrics in the Prometheus text format, so a track session can be scraped
+var (
+	framesProcessed = newMetric("rover_controller_frames_processed_total", "counter", "Imaging frames that led to a steering decision")
+	framesDropped   = newMetric("rover_controller_frames_dropped_total", "counter", "Imaging frames that were invalid, too old or ignored during a stop or manual control")
+	framesSkipped   = newMetric("rover_controller_frames_skipped_total", "counter", "Imaging frames that were queued behind a newer frame and skipped")
+	framesMissed    = newMetric("rover_controller_frames_missed_total", "counter", "Imaging frames that never arrived, counted from the sequence numbers or estimated from the frame timestamps")
+	framesDuplicate = newMetric("rover_controller_frames_duplicate_total", "counter", "Imaging frames that were received twice")
+	framesReordered = newMetric("rover_controller_frames_reordered_total", "counter", "Imaging frames that arrived after a newer frame")
+	imagingRestarts = newMetric("rover_controller_imaging_restarts_total", "counter", "Restarts of the imaging module, noticed from a new session")
+	framesStale     = newMetric("rover_controller_frames_stale_total", "counter", "Imaging frames rejected because they were older than max-frame-age-ms")
+	framesTimedOut  = newMetric("rover_controller_frames_timed_out_total", "counter", "Times the rover was stopped because no imaging frame was steered on for max-frame-age-ms")
+	frameAgeGauge   = newMetric("rover_controller_frame_age_seconds", "gauge", "Age (from capture) of the last imaging frame when the controller checked it")
+	laneLost        = newMetric("rover_controller_lane_lost_total", "counter", "Imaging frames without trajectory points")
+	lookaheadRow    = newMetric("rover_controller_lookahead_row", "gauge", "Image row of the trajectory point that is steered on")
+	steeringError   = newMetric("rover_controller_error", "gauge", "Error of the steering controller")
+	steeringValue   = newMetric("rover_controller_steering", "gauge", "Steering value sent to the actuator")
+	throttleValue   = newMetric("rover_controller_throttle", "gauge", "Throttle sent to the actuator")
+	controllerFps   = newMetric("rover_controller_fps", "gauge", "Decisions per second based on imaging frames, smoothed over a few frames")
+	stoppedGauge    = newMetric("rover_controller_stopped", "gauge", "1 while the emergency stop is latched")
+	cameraGauge     = newMetric("rover_controller_camera_unhealthy", "gauge", "1 while the imaging module reports an unhealthy camera and the rover is stopped")
+	autonomousGauge = newMetric("rover_controller_autonomous", "gauge", "1 while the steering controller drives, 0 during manual control")
+	confidenceGauge = newMetric("rover_controller_confidence", "gauge", "Confidence of the imaging module in the last frame, 1 if it does not send one")
+	obstacleGauge   = newMetric("rover_controller_obstacle_distance_meters", "gauge", "Distance of the obstacle on the lane reported by the imaging module, -1 when there is none")
+	lowConfidence   = newMetric("rover_controller_low_confidence_total", "counter", "Imaging frames below min-confidence, the previous steering was kept")
+)
+
+// All metrics, in the order they are served
+var metrics []*metric
+
+// A counter or gauge, the value is stored as float64 bits so it can be changed without a lock
+type metric struct {
+	name string
+	kind string // "counter" or "gauge"
+	help string
+	bits atomic.Uint64
+}
+
+func newMetric(name string, kind string, help string) *metric {
+	m := &metric{name: name, kind: kind, help: help}
+	metrics = append(metrics, m)
+	return m
+}
+
+func (m *metric) inc() {
+	m.add(1)
+}
+
+func (m *metric) add(delta float64) {
+	for {
+		old := m.bits.Load()
+		if m.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (m *metric) set(value float64) {
+	m.bits.Store(math.Float64bits(value))
+}
+
+func (m *metric) value() float64 {
+	return math.Float64frombits(m.bits.Load())
+}
+
+// 1 for true, 0 for false
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func registerMetrics(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", serveMetrics)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value())
+	}
+	writeLatencyMetrics(w)
+}
+
+// Writes the latency histograms (see latency.go), in seconds as Prometheus expects
+func writeLatencyMetrics(w io.Writer) {
+	const name = "rover_controller_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency per stage from camera capture to the decision\n# TYPE %s histogram\n", name, name)
+	for _, s := range latencies.summary() {
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += s.Latency.Counts[i]
+			fmt.Fprintf(w, "%s_bucket{stage=%q,le=\"%g\"} %d\n", name, s.Stage, bound/1000, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{stage=%q,le=\"+Inf\"} %d\n", name, s.Stage, s.Latency.Count)
+		fmt.Fprintf(w, "%s_sum{stage=%q} %g\n", name, s.Stage, s.Latency.Sum/1000)
+		fmt.Fprintf(w, "%s_count{stage=%q} %d\n", name, s.Stage, s.Latency.Count)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
+	servicerunner "github.com/VU-ASE/pkg-ServiceRunner/v2/src"
+)
+
+// Model-predictive steering based on a (linearised) kinematic bicycle model.
+//
+// Everything is expressed in the frame of the rover at the moment the frame was taken: s points forward,
+// l points to the right (towards a larger X in the image). The trajectory points are mapped from pixels to
+// meters with a flat-ground approximation (see mpc-view-width and mpc-view-depth in service.yaml). The imaging module
+// publishes the lane center in the lookahead row and in a few rows below it, so the reference is a path, not a point.
+//
+// For a steering command u in [-1,1] the model is
+//   heading[k+1] = heading[k] + v*dt/wheelbase * maxSteeringAngle * u[k]
+//   lateral[k+1] = lateral[k] + v*dt * heading[k]
+// so the predicted lateral offsets are linear in the commands, and the problem becomes a small QP:
+//   minimize  sum lateralWeight*(lateral[k]-reference[k])^2 + steeringWeight*u[k]^2 + steeringRateWeight*(u[k]-u[k-1])^2
+//   subject   -1 <= u[k] <= 1  and  |u[k]-u[k-1]| <= maxSteeringRate
+// which is solved with a fixed number of projected gradient steps, so the solve time is bounded and tiny
+// (horizon^2 * iterations multiply-adds) on the rover's ARM CPU.
+
+// Number of projected gradient iterations per frame, the solution is warm started from the previous frame
+const mpcIterations = 60
+
+type mpcConfig struct {
+	horizon            int     // number of prediction steps
+	timestep           float64 // seconds per prediction step
+	wheelbase          float64 // meters
+	maxSteeringAngle   float64 // wheel angle (radians) for a steering command of 1
+	maxSteeringRate    float64 // maximum change of the steering command per step
+	maxVelocity        float64 // meters per second at throttle 1
+	viewWidth          float64 // meters covered by the width of the image
+	viewDepth          float64 // meters between the bottom and the top row of the image
+	lateralWeight      float64
+	steeringWeight     float64
+	steeringRateWeight float64
+}
+
+// Reads the MPC options from the tuning state
+func getMpcConfig(tuning *pb_systemmanager_messages.TuningState) (mpcConfig, error) {
+	config := mpcConfig{}
+
+	horizon, err := servicerunner.GetTuningInt("mpc-horizon", tuning)
+	if err != nil {
+		return config, err
+	}
+	config.horizon = horizon
+
+	floatOptions := []struct {
+		name  string
+		value *float64
+	}{
+		{"mpc-timestep", &config.timestep},
+		{"mpc-wheelbase", &config.wheelbase},
+		{"mpc-max-steering-angle", &config.maxSteeringAngle},
+		{"mpc-max-steering-rate", &config.maxSteeringRate},
+		{"mpc-max-velocity", &config.maxVelocity},
+		{"mpc-view-width", &config.viewWidth},
+		{"mpc-view-depth", &config.viewDepth},
+		{"mpc-lateral-weight", &config.lateralWeight},
+		{"mpc-steering-weight", &config.steeringWeight},
+		{"mpc-steering-rate-weight", &config.steeringRateWeight},
+	}
+	for _, option := range floatOptions {
+		value, err := servicerunner.GetTuningFloat(option.name, tuning)
+		if err != nil {
+			return config, err
+		}
+		*option.value = float64(value)
+	}
+
+	if config.horizon < 1 || config.horizon > 50 {
+		return config, fmt.Errorf("mpc-horizon must be between 1 and 50, got %d", config.horizon)
+	}
+	if config.timestep <= 0 || config.wheelbase <= 0 || config.viewWidth <= 0 || config.viewDepth <= 0 {
+		return config, fmt.Errorf("mpc-timestep, mpc-wheelbase, mpc-view-width and mpc-view-depth must be positive")
+	}
+	if config.maxSteeringRate <= 0 {
+		return config, fmt.Errorf("mpc-max-steering-rate must be positive, got %f", config.maxSteeringRate)
+	}
+	return config, nil
+}
+
+type mpcSteering struct {
+	config mpcConfig
+
+	previous  float64   // steering command applied in the previous frame (positive is right)
+	solution  []float64 // steering commands over the horizon, used as warm start
+	gain      []float64 // horizon x horizon, lateral offset per steering command
+	hessian   []float64 // horizon x horizon
+	linear    []float64
+	reference []float64
+	gradient  []float64
+	path      []mpcPathPoint
+}
+
+// A trajectory point in the rover frame, in meters
+type mpcPathPoint struct {
+	s float64
+	l float64
+}
+
+func newMpcSteering(config mpcConfig) *mpcSteering {
+	n := config.horizon
+	return &mpcSteering{
+		config:    config,
+		solution:  make([]float64, n),
+		gain:      make([]float64, n*n),
+		hessian:   make([]float64, n*n),
+		linear:    make([]float64, n),
+		reference: make([]float64, n),
+		gradient:  make([]float64, n),
+	}
+}
+
+func (m *mpcSteering) Reset() {
+	m.previous = 0
+	for i := range m.solution {
+		m.solution[i] = 0
+	}
+}
+
+// The error is the lateral offset of the path (in meters) after the first prediction step
+func (m *mpcSteering) Terms() controlTerms {
+	return controlTerms{Error: m.reference[0]}
+}
+
+// The MPC plans on the trajectory points, which it already converts to meters, so it does not use the lane geometry
+func (m *mpcSteering) Update(trajectory *pb_outputs.CameraSensorOutput_Trajectory, lane *laneGeometry, desiredX float64, speed float32) float64 {
+	n := m.config.horizon
+	velocity := float64(speed) * m.config.maxVelocity
+	stepDistance := velocity * m.config.timestep
+	m.buildReference(trajectory, desiredX, stepDistance)
+
+	// Heading change per step for a steering command of 1
+	headingGain := stepDistance * m.config.maxSteeringAngle / m.config.wheelbase
+	// lateral[i+1] = sum over j < i of stepDistance * headingGain * (i-j) * u[j]
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			m.gain[i*n+j] = 0
+			if j < i {
+				m.gain[i*n+j] = stepDistance * headingGain * float64(i-j)
+			}
+		}
+	}
+
+	// Build the QP cost 1/2 u'Hu - f'u (up to a constant factor of 2)
+	q := m.config.lateralWeight
+	r := m.config.steeringWeight
+	w := m.config.steeringRateWeight
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			sum := 0.0
+			for k := 0; k < n; k++ {
+				sum += m.gain[k*n+i] * m.gain[k*n+j]
+			}
+			m.hessian[i*n+j] = q * sum
+		}
+		m.hessian[i*n+i] += r
+
+		// Rate penalty, a tridiagonal difference matrix (the last command has only one neighbour)
+		if i < n-1 {
+			m.hessian[i*n+i] += 2 * w
+		} else {
+			m.hessian[i*n+i] += w
+		}
+		if i > 0 {
+			m.hessian[i*n+i-1] -= w
+			m.hessian[(i-1)*n+i] -= w
+		}
+
+		linear := 0.0
+		for k := 0; k < n; k++ {
+			linear += m.gain[k*n+i] * m.reference[k]
+		}
+		m.linear[i] = q * linear
+	}
+	m.linear[0] += w * m.previous
+
+	// Step size from the Gershgorin bound on the largest eigenvalue
+	lipschitz := 0.0
+	for i := 0; i < n; i++ {
+		row := 0.0
+		for j := 0; j < n; j++ {
+			row += math.Abs(m.hessian[i*n+j])
+		}
+		lipschitz = math.Max(lipschitz, row)
+	}
+	if lipschitz == 0 {
+		lipschitz = 1
+	}
+
+	// Warm start: shift the previous solution by one step
+	copy(m.solution, m.solution[1:])
+	m.project(m.solution)
+
+	for iteration := 0; iteration < mpcIterations; iteration++ {
+		for i := 0; i < n; i++ {
+			sum := -m.linear[i]
+			for j := 0; j < n; j++ {
+				sum += m.hessian[i*n+j] * m.solution[j]
+			}
+			m.gradient[i] = sum
+		}
+		for i := 0; i < n; i++ {
+			m.solution[i] -= m.gradient[i] / lipschitz
+		}
+		m.project(m.solution)
+	}
+
+	m.previous = m.solution[0]
+	// Positive commands steer right, which is a negative PID control signal
+	return -m.solution[0]
+}
+
+// Projects the steering commands onto the actuator range and the steering rate constraint.
+// This is done sequentially, so the result is always feasible (but not the exact euclidean projection)
+func (m *mpcSteering) project(commands []float64) {
+	previous := m.previous
+	for i, command := range commands {
+		low := math.Max(-1, previous-m.config.maxSteeringRate)
+		high := math.Min(1, previous+m.config.maxSteeringRate)
+		commands[i] = math.Min(high, math.Max(low, command))
+		previous = commands[i]
+	}
+}
+
+// Converts the trajectory points to the rover frame and samples the lateral reference at the distance
+// the rover will have travelled after each prediction step
+func (m *mpcSteering) buildReference(trajectory *pb_outputs.CameraSensorOutput_Trajectory, desiredX float64, stepDistance float64) {
+	width, height := trajectorySize(trajectory)
+
+	m.path = m.path[:0]
+	for _, point := range trajectory.GetPoints() {
+		m.path = append(m.path, mpcPathPoint{
+			s: (height - float64(point.Y)) / height * m.config.viewDepth,
+			l: (float64(point.X) - desiredX) / width * m.config.viewWidth,
+		})
+	}
+	sort.Slice(m.path, func(i, j int) bool { return m.path[i].s < m.path[j].s })
+
+	for k := range m.reference {
+		m.reference[k] = m.lateralAt(stepDistance * float64(k+1))
+	}
+}
+
+// Linear interpolation of the lateral offset of the path, clamped to the first and last point
+func (m *mpcSteering) lateralAt(s float64) float64 {
+	if len(m.path) == 0 {
+		return 0
+	}
+	if s <= m.path[0].s {
+		return m.path[0].l
+	}
+	for i := 1; i < len(m.path); i++ {
+		if s <= m.path[i].s {
+			from := m.path[i-1]
+			to := m.path[i]
+			if to.s == from.s {
+				return to.l
+			}
+			return from.l + (to.l-from.l)*(s-from.s)/(to.s-from.s)
+		}
+	}
+	return m.path[len(m.path)-1].l
+}
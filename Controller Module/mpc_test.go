@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+)
+
+// The defaults of service.yaml
+var testMpcConfig = mpcConfig{
+	horizon:            10,
+	timestep:           0.1,
+	wheelbase:          0.17,
+	maxSteeringAngle:   0.4,
+	maxSteeringRate:    0.3,
+	maxVelocity:        2.0,
+	viewWidth:          0.6,
+	viewDepth:          1.0,
+	lateralWeight:      1.0,
+	steeringWeight:     0.01,
+	steeringRateWeight: 0.05,
+}
+
+// A 640x480 trajectory with its points at the given X in the rows of the lower half of the image
+func testTrajectory(xs ...uint32) *pb_outputs.CameraSensorOutput_Trajectory {
+	trajectory := &pb_outputs.CameraSensorOutput_Trajectory{Width: 640, Height: 480}
+	for i, x := range xs {
+		trajectory.Points = append(trajectory.Points, &pb_outputs.CameraSensorOutput_Trajectory_Point{
+			X: x,
+			Y: uint32(280 + i*60),
+		})
+	}
+	return trajectory
+}
+
+func TestMpcSteering(t *testing.T) {
+	tests := []struct {
+		name       string
+		trajectory *pb_outputs.CameraSensorOutput_Trajectory
+		sign       float64 // expected sign of the returned value, 0 for about 0
+	}{
+		{"centered", testTrajectory(320, 320, 320, 320), 0},
+		// The PID convention: a lane to the right gives a negative control signal
+		{"lane to the right", testTrajectory(420, 400, 380, 360), -1},
+		{"lane to the left", testTrajectory(220, 240, 260, 280), 1},
+		{"single point to the right", testTrajectory(400), -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMpcSteering(testMpcConfig)
+			got := m.Update(test.trajectory, nil, 320, 0.2)
+			switch {
+			case test.sign == 0 && math.Abs(got) > 1e-9:
+				t.Errorf("steering %f, want 0", got)
+			case test.sign != 0 && got*test.sign <= 0:
+				t.Errorf("steering %f, want the sign of %f", got, test.sign)
+			}
+		})
+	}
+}
+
+func TestMpcSteeringConstraints(t *testing.T) {
+	m := newMpcSteering(testMpcConfig)
+	// Far off to either side, the unconstrained solution is well outside the actuator range
+	trajectories := []*pb_outputs.CameraSensorOutput_Trajectory{
+		testTrajectory(639, 639, 639, 639),
+		testTrajectory(639, 639, 639, 639),
+		testTrajectory(639, 639, 639, 639),
+		testTrajectory(639, 639, 639, 639),
+		testTrajectory(0, 0, 0, 0),
+		testTrajectory(0, 0, 0, 0),
+		testTrajectory(0, 0, 0, 0),
+		testTrajectory(320, 320, 320, 320),
+	}
+	previous := 0.0
+	for i, trajectory := range trajectories {
+		got := m.Update(trajectory, nil, 320, 0.5)
+		if got < -1 || got > 1 {
+			t.Errorf("frame %d: steering %f is outside [-1,1]", i, got)
+		}
+		if math.Abs(got-previous) > testMpcConfig.maxSteeringRate+1e-9 {
+			t.Errorf("frame %d: steering changed from %f to %f, more than the rate limit %f", i, previous, got, testMpcConfig.maxSteeringRate)
+		}
+		for k := 1; k < len(m.solution); k++ {
+			if math.Abs(m.solution[k]-m.solution[k-1]) > testMpcConfig.maxSteeringRate+1e-9 {
+				t.Errorf("frame %d: planned steering changes more than the rate limit at step %d", i, k)
+			}
+		}
+		previous = got
+	}
+	// After four frames far to the right the command is at the end of the range
+	m.Reset()
+	for i := 0; i < 4; i++ {
+		previous = m.Update(trajectories[0], nil, 320, 0.5)
+	}
+	if previous != -1 {
+		t.Errorf("steering %f after four frames with the lane far to the right, want -1", previous)
+	}
+}
+
+func TestMpcSteeringReset(t *testing.T) {
+	m := newMpcSteering(testMpcConfig)
+	m.Update(testTrajectory(500, 500, 500, 500), nil, 320, 0.2)
+	m.Reset()
+	if got := m.Update(testTrajectory(320, 320, 320, 320), nil, 320, 0.2); math.Abs(got) > 1e-9 {
+		t.Errorf("steering %f on a centered trajectory after a reset, want 0", got)
+	}
+}
+
+func TestMpcSteeringFitsFrameBudget(t *testing.T) {
+	// A tenth of a frame at 30 fps, the controller does more per frame than steering
+	const budget = time.Second / 30 / 10
+	m := newMpcSteering(testMpcConfig)
+	trajectory := testTrajectory(400, 380, 360, 340)
+	const solves = 50
+	start := time.Now()
+	for i := 0; i < solves; i++ {
+		m.Update(trajectory, nil, 320, 0.2)
+	}
+	if perSolve := time.Since(start) / solves; perSolve > budget {
+		t.Errorf("one solve takes %v, more than %v", perSolve, budget)
+	}
+}
+
+func BenchmarkMpcSteering(b *testing.B) {
+	m := newMpcSteering(testMpcConfig)
+	trajectory := testTrajectory(400, 380, 360, 340)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Update(trajectory, nil, 320, 0.2)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// Set in the Flags of the CameraSensorOutput when the imaging module sees an obstacle on the lane ahead, its distance
+// is in the frame extension. Keep this in sync with the imaging module's obstacle.go.
+const flagObstacle = uint32(1 << 1)
+
+// Slows the rover down for an obstacle and stops it before it. The imaging module reports the distance as a fraction
+// of the image height, it is converted to meters with the same flat-ground approximation as the MPC (mpc-view-depth).
+type obstacleBrake struct {
+	slowdown  float64 // meters, closer obstacles lower the throttle
+	stop      float64 // meters, closer obstacles stop the rover
+	viewDepth float64 // meters between the bottom and the top row of the image
+}
+
+func newObstacleBrake(slowdown float64, stop float64, viewDepth float64) (obstacleBrake, error) {
+	if stop < 0 || slowdown < stop {
+		return obstacleBrake{}, fmt.Errorf("obstacle-slowdown-distance (%f) must be at least obstacle-stop-distance (%f), which must not be negative", slowdown, stop)
+	}
+	return obstacleBrake{slowdown: slowdown, stop: stop, viewDepth: viewDepth}, nil
+}
+
+// Returns the distance in meters of an obstacle reported at the given fraction of the image height
+func (b obstacleBrake) meters(distance float32) float64 {
+	return float64(distance) * b.viewDepth
+}
+
+// Returns the factor for the throttle with an obstacle at the given distance in meters, from 0 (stop) to 1
+func (b obstacleBrake) speedFactor(meters float64) float64 {
+	switch {
+	case meters <= b.stop:
+		return 0
+	case meters >= b.slowdown:
+		return 1
+	}
+	return (meters - b.stop) / (b.slowdown - b.stop)
+}
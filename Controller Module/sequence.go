@@ -0,0 +1,91 @@
+package main
+
+import "github.com/rs/zerolog/log"
+
+// What a received frame means for the imaging link, judged from its sequence number and session
+type linkEvent int
+
+const (
+	linkInOrder   linkEvent = iota // the next frame, or a later one when frames were lost
+	linkFirst                      // the first frame the controller sees
+	linkRestarted                  // the imaging module restarted, the sequence numbers start over
+	linkDuplicate                  // the same frame was received before
+	linkReordered                  // an older frame than the last one, it arrived out of order
+)
+
+func (e linkEvent) String() string {
+	switch e {
+	case linkFirst:
+		return "first"
+	case linkRestarted:
+		return "restarted"
+	case linkDuplicate:
+		return "duplicate"
+	case linkReordered:
+		return "reordered"
+	default:
+		return "in order"
+	}
+}
+
+// Follows the sequence numbers of the imaging module (see extension.go)
+type sequenceTracker struct {
+	session   uint64
+	last      uint64 // 0 until the first frame
+	resyncing bool   // the next frame continues the session, without counting the frames in between as lost
+}
+
+// Call this when frames are ignored on purpose (e.g. during a stop)
+func (t *sequenceTracker) resync() {
+	t.resyncing = true
+}
+
+// Registers a received frame. Returns what happened on the link and, for frames in order, how many frames were lost
+// before it. skipped is the number of frames that did arrive but were skipped by receiveLatest, those are not lost.
+func (t *sequenceTracker) observe(session uint64, sequence uint64, skipped int) (linkEvent, int) {
+	switch {
+	case t.last == 0:
+		t.session, t.last = session, sequence
+		return linkFirst, 0
+	case session != t.session:
+		t.session, t.last = session, sequence
+		return linkRestarted, 0
+	case sequence == t.last:
+		return linkDuplicate, 0
+	case sequence < t.last:
+		return linkReordered, 0
+	case t.resyncing:
+		t.last, t.resyncing = sequence, false
+		return linkInOrder, 0
+	}
+
+	lost := max(int(sequence-t.last)-1-skipped, 0)
+	t.last = sequence
+	return linkInOrder, lost
+}
+
+// Registers a received frame like observe and acts on the event: a restart of the imaging module resets the steering
+// controller and lost frames are counted. Returns false for duplicate and reordered frames, those are not steered on.
+func (t *sequenceTracker) accept(session uint64, sequence uint64, skipped int, steering steeringController) bool {
+	event, lost := t.observe(session, sequence, skipped)
+	switch event {
+	case linkRestarted:
+		// The lane the controller remembers may be long gone
+		log.Warn().Uint64("session", session).Msg("Imaging module restarted, resetting the steering controller")
+		imagingRestarts.inc()
+		steering.Reset()
+	case linkDuplicate, linkReordered:
+		log.Warn().Uint64("sequence", sequence).Stringer("event", event).Msg("Dropped imaging frame")
+		if event == linkDuplicate {
+			framesDuplicate.inc()
+		} else {
+			framesReordered.inc()
+		}
+		return false
+	}
+	if lost > 0 {
+		log.Debug().Int("lost", lost).Uint64("sequence", sequence).Msg("Imaging frames lost")
+		framesMissed.add(float64(lost))
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+
+	"go.einride.tech/pid"
+)
+
+// A frame received by the controller, or a resync (a stop) before it
+type sequenceStep struct {
+	session  uint64
+	sequence uint64
+	skipped  int
+	resync   bool
+	event    linkEvent
+	lost     int
+}
+
+func TestSequenceTracker(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []sequenceStep
+	}{
+		{"in order", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			{session: 1, sequence: 2, event: linkInOrder},
+			{session: 1, sequence: 3, event: linkInOrder},
+		}},
+		{"first frame late in the session", []sequenceStep{
+			{session: 1, sequence: 500, event: linkFirst},
+			{session: 1, sequence: 501, event: linkInOrder},
+		}},
+		{"drops", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			{session: 1, sequence: 5, event: linkInOrder, lost: 3},
+			{session: 1, sequence: 6, event: linkInOrder},
+		}},
+		{"drops and skipped frames", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			// Frames 2 and 3 arrived but were skipped by receiveLatest, 4 never arrived
+			{session: 1, sequence: 5, skipped: 2, event: linkInOrder, lost: 1},
+			// Skipped frames that were already counted do not make the count negative
+			{session: 1, sequence: 6, skipped: 3, event: linkInOrder},
+		}},
+		{"duplicates", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			{session: 1, sequence: 2, event: linkInOrder},
+			{session: 1, sequence: 2, event: linkDuplicate},
+			{session: 1, sequence: 3, event: linkInOrder},
+		}},
+		{"reordering", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			{session: 1, sequence: 3, event: linkInOrder, lost: 1},
+			// Counted as lost above, it arrived after all
+			{session: 1, sequence: 2, event: linkReordered},
+			{session: 1, sequence: 4, event: linkInOrder},
+		}},
+		{"restarts", []sequenceStep{
+			{session: 1, sequence: 100, event: linkFirst},
+			// The sequence numbers start over, these are not reordered frames
+			{session: 2, sequence: 1, event: linkRestarted},
+			{session: 2, sequence: 2, event: linkInOrder},
+			{session: 2, sequence: 4, event: linkInOrder, lost: 1},
+			{session: 3, sequence: 9, event: linkRestarted},
+			{session: 3, sequence: 10, event: linkInOrder},
+		}},
+		{"frames from before a restart", []sequenceStep{
+			{session: 1, sequence: 100, event: linkFirst},
+			{session: 2, sequence: 1, event: linkRestarted},
+			// A frame of the old session that was still underway is a restart as well, it is followed right away
+			{session: 1, sequence: 101, event: linkRestarted},
+		}},
+		{"resync", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			// The frames ignored during a stop are not lost
+			{session: 1, sequence: 20, resync: true, event: linkInOrder},
+			{session: 1, sequence: 22, event: linkInOrder, lost: 1},
+		}},
+		{"duplicate after a resync", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			{session: 1, sequence: 1, resync: true, event: linkDuplicate},
+			// Still resyncing
+			{session: 1, sequence: 10, event: linkInOrder},
+		}},
+		// The camera health messages are numbered in the same sequence as the frames (see publishCameraUnhealthy in the
+		// imaging module). The controller observes them as well, otherwise the frames after an unhealthy camera would
+		// count them as lost.
+		{"camera health messages", []sequenceStep{
+			{session: 1, sequence: 1, event: linkFirst},
+			{session: 1, sequence: 2, event: linkInOrder},
+			// Camera health
+			{session: 1, sequence: 3, event: linkInOrder},
+			{session: 1, sequence: 4, event: linkInOrder},
+			// Frames again
+			{session: 1, sequence: 5, event: linkInOrder},
+			{session: 1, sequence: 6, event: linkInOrder},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := sequenceTracker{}
+			for i, step := range test.steps {
+				if step.resync {
+					tracker.resync()
+				}
+				event, lost := tracker.observe(step.session, step.sequence, step.skipped)
+				if event != step.event || lost != step.lost {
+					t.Errorf("step %d (session %d, sequence %d, skipped %d): %v with %d lost, want %v with %d lost",
+						i, step.session, step.sequence, step.skipped, event, lost, step.event, step.lost)
+				}
+			}
+		})
+	}
+}
+
+func TestSequenceTrackerAccept(t *testing.T) {
+	controller := &pid.Controller{Config: pid.ControllerConfig{ProportionalGain: 1, IntegralGain: 1}}
+	steering := &pidSteering{controller: controller, errorMode: errorModePixel}
+	tracker := sequenceTracker{}
+	restarts := imagingRestarts.value()
+	duplicates := framesDuplicate.value()
+	reordered := framesReordered.value()
+	missed := framesMissed.value()
+
+	steps := []struct {
+		session  uint64
+		sequence uint64
+		accepted bool
+		reset    bool // whether the PID state was cleared
+	}{
+		{session: 1, sequence: 1, accepted: true},
+		{session: 1, sequence: 2, accepted: true},
+		{session: 1, sequence: 2},
+		{session: 1, sequence: 5, accepted: true},
+		{session: 1, sequence: 4},
+		// The imaging module restarted, the integrator holds errors of a lane that may be long gone
+		{session: 2, sequence: 1, accepted: true, reset: true},
+		{session: 2, sequence: 2, accepted: true},
+	}
+	for i, step := range steps {
+		// State of the frames before, the restart must clear it
+		controller.State = pid.ControllerState{ControlError: 10, ControlErrorIntegral: 3, ControlSignal: 13}
+		if got := tracker.accept(step.session, step.sequence, 0, steering); got != step.accepted {
+			t.Errorf("step %d (session %d, sequence %d): accepted %v, want %v", i, step.session, step.sequence, got, step.accepted)
+		}
+		if reset := controller.State == (pid.ControllerState{}); reset != step.reset {
+			t.Errorf("step %d (session %d, sequence %d): PID state cleared %v, want %v", i, step.session, step.sequence, reset, step.reset)
+		}
+	}
+
+	counters := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"restarts", imagingRestarts.value() - restarts, 1},
+		{"duplicates", framesDuplicate.value() - duplicates, 1},
+		{"reordered", framesReordered.value() - reordered, 1},
+		{"missed", framesMissed.value() - missed, 2},
+	}
+	for _, counter := range counters {
+		if counter.got != counter.want {
+			t.Errorf("%v %s counted, want %v", counter.got, counter.name, counter.want)
+		}
+	}
+}
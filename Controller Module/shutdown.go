@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long the termination waits for the main loop to send the final decision and close its sockets
+const shutdownTimeout = 2 * time.Second
+
+// How long closing the decision socket waits for the final decision to be sent
+const finalDecisionLinger = 500 * time.Millisecond
+
+var (
+	// Closed when the service is terminated, the main loop checks it every iteration
+	stopping = make(chan struct{})
+	stopOnce sync.Once
+	// Closed when run returned and released the sockets and the keyboard
+	stopped = make(chan struct{})
+)
+
+// Signals the main loop to stop, safe to call more than once
+func stop() {
+	stopOnce.Do(func() { close(stopping) })
+}
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Called by the service runner on SIGINT/SIGTERM. The main loop sends a zero throttle decision, so the rover
+// does not keep driving on the last decision, and closes everything. The wait is bounded, the service runner
+// exits after this returns.
+func onTerminate(sig os.Signal) {
+	log.Info().Str("signal", sig.String()).Msg("Terminating, stopping the rover")
+	stop()
+	select {
+	case <-stopped:
+		log.Info().Msg("Controller stopped")
+	case <-time.After(shutdownTimeout):
+		log.Warn().Dur("timeout", shutdownTimeout).Msg("Controller did not stop in time")
+	}
+}
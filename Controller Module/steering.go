@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	pid "go.einride.tech/pid"
+)
+
+// A steeringController turns the trajectory published by the imaging module into a steering value.
+// The returned value uses the sign convention of the PID control signal, it is clamped to [-1,1] and
+// inverted by the main loop before it is sent out on the decision output
+type steeringController interface {
+	// Update computes a new steering value to bring the trajectory to the desired X (in pixels), lane is the
+	// geometry measured by the imaging module (nil if it did not send it) and speed is the throttle that will be
+	// sent alongside it
+	Update(trajectory *pb_outputs.CameraSensorOutput_Trajectory, lane *laneGeometry, desiredX float64, speed float32) float64
+	// Reset clears all internal state (integrators, warm starts)
+	Reset()
+	// Terms returns the error and the contributions to the steering value of the last update
+	Terms() controlTerms
+}
+
+// The error and the contributions of the P, I and D terms (only the error is set for controllers other than PID)
+type controlTerms struct {
+	Error        float64
+	Proportional float64
+	Integral     float64
+	Derivative   float64
+}
+
+// Size of the images of older imaging modules, which do not publish it
+const (
+	defaultTrajectoryWidth  = 640
+	defaultTrajectoryHeight = 480
+)
+
+// Size of the image the trajectory was found in
+func trajectorySize(trajectory *pb_outputs.CameraSensorOutput_Trajectory) (float64, float64) {
+	width := float64(trajectory.GetWidth())
+	height := float64(trajectory.GetHeight())
+	if width == 0 || height == 0 {
+		return defaultTrajectoryWidth, defaultTrajectoryHeight
+	}
+	return width, height
+}
+
+func trajectoryWidth(trajectory *pb_outputs.CameraSensorOutput_Trajectory) float64 {
+	width, _ := trajectorySize(trajectory)
+	return width
+}
+
+// What the PID controller regulates:
+//
+//	pixel       the X of the first trajectory point in pixels, so the gains depend on the resolution
+//	normalized  the lateral offset of the lane (-1 and 1 are the image edges) plus the heading of the lane (in radians) times the heading
+//	            gain, the same gains work for any resolution
+const (
+	errorModePixel      = "pixel"
+	errorModeNormalized = "normalized"
+)
+
+// The classic controller, steers on the first trajectory point only
+type pidSteering struct {
+	controller  *pid.Controller
+	errorMode   string  // set from the tuning every frame
+	headingGain float64 // set from the tuning every frame
+}
+
+func (p *pidSteering) Update(trajectory *pb_outputs.CameraSensorOutput_Trajectory, lane *laneGeometry, desiredX float64, speed float32) float64 {
+	firstPoint := trajectory.GetPoints()[0]
+	reference, actual := desiredX, float64(firstPoint.X)
+	if p.errorMode == errorModeNormalized {
+		// Without a measured lane (older imaging modules) the offset follows from the first point, without heading
+		width := trajectoryWidth(trajectory)
+		reference = 2*desiredX/width - 1
+		actual = 2*float64(firstPoint.X)/width - 1
+		if lane != nil {
+			actual = float64(lane.offset) + p.headingGain*float64(lane.heading)
+		}
+	}
+	p.controller.Update(pid.ControllerInput{
+		ReferenceSignal:  reference,
+		ActualSignal:     actual,
+		SamplingInterval: 100 * time.Millisecond,
+	})
+	return p.controller.State.ControlSignal
+}
+
+func (p *pidSteering) Reset() {
+	p.controller.Reset()
+}
+
+func (p *pidSteering) Terms() controlTerms {
+	config := p.controller.Config
+	state := p.controller.State
+	return controlTerms{
+		Error:        state.ControlError,
+		Proportional: config.ProportionalGain * state.ControlError,
+		Integral:     config.IntegralGain * state.ControlErrorIntegral,
+		Derivative:   config.DerivativeGain * state.ControlErrorDerivative,
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	keyboard "github.com/eiannone/keyboard"
+	"github.com/rs/zerolog/log"
+)
+
+// Keyboard teleop, only enabled with the "keyboard" option since it needs an interactive terminal
+//
+//   m                  toggle autonomy on/off (manual override)
+//   space              emergency stop: zero throttle and neutral steering until cleared
+//   r                  clear the emergency stop
+//   arrow up/down      autonomous: change the speed, manual: change the throttle
+//   arrow left/right   manual: steer
+//   ctrl-a/ctrl-s      increase/decrease kp
+//   ctrl-d/ctrl-h      increase/decrease kd
+//   esc                stop and close the keyboard
+
+// Who is driving the rover: the steering controller (autonomous) or the operator (manual)
+type driveCommand struct {
+	autonomous bool
+	steering   float32 // manual steering in [-1,1], positive is right (sent to the actuator as is)
+	throttle   float32 // manual throttle
+}
+
+// Global, shared between the keyboard and the main loop
+var driveLock sync.Mutex
+var drive = driveCommand{autonomous: true}
+
+// Returns a copy of the current drive command
+func currentDrive() driveCommand {
+	driveLock.Lock()
+	defer driveLock.Unlock()
+	return drive
+}
+
+// Changes the drive command and returns the result
+func updateDrive(change func(*driveCommand)) driveCommand {
+	driveLock.Lock()
+	defer driveLock.Unlock()
+	change(&drive)
+	return drive
+}
+
+// Manual and stop decisions are repeated at least this often, also when no imaging frames arrive
+const manualDecisionInterval = 50 * time.Millisecond
+
+const (
+	speedIncrement    = float32(0.05)
+	steeringIncrement = float32(0.1)
+	kpIncrement       = float32(0.00005)
+	kdIncrement       = float32(0.0001)
+)
+
+var keyboardClose sync.Once
+
+// Closes the keyboard and restores the terminal, safe to call more than once
+func closeKeyboard() {
+	keyboardClose.Do(func() { keyboard.Close() })
+}
+
+// Reads key presses until esc is pressed or the service stops, should be run as a goroutine after keyboard.Open()
+func runKeyboard() {
+	for {
+		char, key, err := keyboard.GetKey()
+		if isStopping() {
+			// The keyboard is closed by the main loop
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("Error getting key press")
+			continue
+		}
+
+		if key == keyboard.KeyEsc {
+			closeKeyboard()
+			estop.trigger("keyboard closed")
+			fmt.Println("Stopped, keyboard closed")
+			return
+		}
+		handleKey(char, key)
+
+		time.Sleep(time.Millisecond * 100) // this should delay high CPU usage in case
+	}
+}
+
+func handleKey(char rune, key keyboard.Key) {
+	current := currentTuning()
+	update := tuningUpdate{}
+
+	switch {
+	case char == 'm':
+		d := updateDrive(func(d *driveCommand) {
+			d.autonomous = !d.autonomous
+			d.steering = 0
+			d.throttle = 0
+		})
+		if d.autonomous {
+			fmt.Println("Autonomy on")
+		} else {
+			fmt.Println("Autonomy off, manual control")
+		}
+	case key == keyboard.KeySpace:
+		estop.trigger("keyboard")
+		fmt.Println("Stopped, press r to clear")
+	case char == 'r':
+		updateDrive(func(d *driveCommand) { d.throttle = 0 })
+		err := estop.clear("keyboard")
+		if err != nil {
+			fmt.Println("Not cleared:", err)
+			return
+		}
+		fmt.Println("Stop cleared")
+	case key == keyboard.KeyArrowUp || key == keyboard.KeyArrowDown:
+		delta := speedIncrement
+		if key == keyboard.KeyArrowDown {
+			delta = -delta
+		}
+		if d := currentDrive(); !d.autonomous {
+			d = updateDrive(func(d *driveCommand) { d.throttle = min(max(d.throttle+delta, 0), maxSpeed) })
+			fmt.Println("Throttle set to:", d.throttle)
+			return
+		}
+		speed := min(max(current.Speed+delta, 0), maxSpeed)
+		update.Speed = &speed
+		fmt.Println("Speed set to:", speed)
+	case key == keyboard.KeyArrowLeft || key == keyboard.KeyArrowRight:
+		delta := steeringIncrement
+		if key == keyboard.KeyArrowLeft {
+			delta = -delta
+		}
+		d := updateDrive(func(d *driveCommand) {
+			if !d.autonomous {
+				d.steering = min(max(d.steering+delta, -1), 1)
+			}
+		})
+		if !d.autonomous {
+			fmt.Println("Steering set to:", d.steering)
+		}
+	case key == keyboard.KeyCtrlA: // increase kp
+		kp := min(current.Kp+kpIncrement, maxGain)
+		update.Kp = &kp
+		fmt.Println("kp increased to:", kp)
+	case key == keyboard.KeyCtrlS: // decrease kp
+		kp := max(current.Kp-kpIncrement, 0)
+		update.Kp = &kp
+		fmt.Println("kp decreased to:", kp)
+	case key == keyboard.KeyCtrlD: // increase kd
+		kd := min(current.Kd+kdIncrement, maxGain)
+		update.Kd = &kd
+		fmt.Println("kd increased to:", kd)
+	case key == keyboard.KeyCtrlH: // decrease kd
+		kd := max(current.Kd-kdIncrement, 0)
+		update.Kd = &kd
+		fmt.Println("kd decreased to:", kd)
+	}
+
+	_, err := applyTuning(update, "keyboard")
+	if err != nil {
+		log.Err(err).Msg("Failed to apply keyboard tuning")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
+	servicerunner "github.com/VU-ASE/pkg-ServiceRunner/v2/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Bounds of the tuning values
+const (
+	maxGain        = 1
+	maxSpeed       = 0.5
+	maxHeadingGain = 2
+)
+
+// The values that can be changed while driving. They are changed by the system manager (onTuningState),
+// the tuning API and the keyboard, all through applyTuning so they are validated the same way
+type controllerTuning struct {
+	Kp                        float32 `json:"kp"`
+	Ki                        float32 `json:"ki"`
+	Kd                        float32 `json:"kd"`
+	Speed                     float32 `json:"speed"`
+	DesiredTrajectoryFraction float32 `json:"desired-trajectory-fraction"` // fraction of the image width, 0.5 is the middle
+	Mode                      string  `json:"controller"`                  // steering controller, "pid" or "mpc", the controller option of service.yaml
+	ErrorMode                 string  `json:"error-mode"`                  // what the PID regulates, "pixel" or "normalized" (see steering.go)
+	HeadingGain               float32 `json:"heading-gain"`                // weight of the lane heading in the normalized error
+}
+
+// A partial change of the tuning, nil fields are left as they are
+type tuningUpdate struct {
+	Kp                        *float32 `json:"kp"`
+	Ki                        *float32 `json:"ki"`
+	Kd                        *float32 `json:"kd"`
+	Speed                     *float32 `json:"speed"`
+	DesiredTrajectoryFraction *float32 `json:"desired-trajectory-fraction"`
+	DesiredTrajectoryPoint    *int     `json:"desired-trajectory-point"` // deprecated, in pixels, only used without desired-trajectory-fraction
+	Mode                      *string  `json:"controller"`
+	ErrorMode                 *string  `json:"error-mode"`
+	HeadingGain               *float32 `json:"heading-gain"`
+}
+
+// Global, since onTuningState is called by the service runner
+var tuningLock sync.Mutex
+var tuning controllerTuning
+
+// Returns a copy of the current tuning
+func currentTuning() controllerTuning {
+	tuningLock.Lock()
+	defer tuningLock.Unlock()
+	return tuning
+}
+
+// Validates the update and applies it, either all values are changed or none
+func applyTuning(update tuningUpdate, source string) (controllerTuning, error) {
+	tuningLock.Lock()
+	defer tuningLock.Unlock()
+
+	next := tuning
+	gains := []struct {
+		name   string
+		value  *float32
+		target *float32
+	}{
+		{"kp", update.Kp, &next.Kp},
+		{"ki", update.Ki, &next.Ki},
+		{"kd", update.Kd, &next.Kd},
+	}
+	for _, gain := range gains {
+		if gain.value == nil {
+			continue
+		}
+		if *gain.value < 0 || *gain.value > maxGain {
+			return tuning, fmt.Errorf("%s must be between 0 and %d, got %f", gain.name, maxGain, *gain.value)
+		}
+		*gain.target = *gain.value
+	}
+	if update.Speed != nil {
+		if *update.Speed < 0 || *update.Speed > maxSpeed {
+			return tuning, fmt.Errorf("speed must be between 0 and %.1f, got %f", maxSpeed, *update.Speed)
+		}
+		next.Speed = *update.Speed
+	}
+	if update.DesiredTrajectoryFraction == nil && update.DesiredTrajectoryPoint != nil {
+		// The setpoint of older configurations, in pixels of the 640 pixels wide frames it was tuned on
+		point := *update.DesiredTrajectoryPoint
+		if point < 0 || point > defaultTrajectoryWidth {
+			return tuning, fmt.Errorf("desired-trajectory-point must be between 0 and %d, got %d", defaultTrajectoryWidth, point)
+		}
+		fraction := float32(point) / defaultTrajectoryWidth
+		update.DesiredTrajectoryFraction = &fraction
+		log.Warn().Str("source", source).Int("desired-trajectory-point", point).Float32("desired-trajectory-fraction", fraction).Msg("desired-trajectory-point is deprecated, use desired-trajectory-fraction")
+	}
+	if update.DesiredTrajectoryFraction != nil {
+		if *update.DesiredTrajectoryFraction < 0 || *update.DesiredTrajectoryFraction > 1 {
+			return tuning, fmt.Errorf("desired-trajectory-fraction must be a fraction of the image width between 0 and 1, got %f", *update.DesiredTrajectoryFraction)
+		}
+		next.DesiredTrajectoryFraction = *update.DesiredTrajectoryFraction
+	}
+	if update.Mode != nil {
+		if *update.Mode != "pid" && *update.Mode != "mpc" {
+			return tuning, fmt.Errorf("controller must be \"pid\" or \"mpc\", got %q", *update.Mode)
+		}
+		next.Mode = *update.Mode
+	}
+	if update.ErrorMode != nil {
+		if *update.ErrorMode != errorModePixel && *update.ErrorMode != errorModeNormalized {
+			return tuning, fmt.Errorf("error-mode must be %q or %q, got %q", errorModePixel, errorModeNormalized, *update.ErrorMode)
+		}
+		next.ErrorMode = *update.ErrorMode
+	}
+	if update.HeadingGain != nil {
+		if *update.HeadingGain < 0 || *update.HeadingGain > maxHeadingGain {
+			return tuning, fmt.Errorf("heading-gain must be between 0 and %d, got %f", maxHeadingGain, *update.HeadingGain)
+		}
+		next.HeadingGain = *update.HeadingGain
+	}
+
+	if next != tuning {
+		log.Info().
+			Str("source", source).
+			Float32("kp", next.Kp).
+			Float32("ki", next.Ki).
+			Float32("kd", next.Kd).
+			Float32("speed", next.Speed).
+			Float32("desired-trajectory-fraction", next.DesiredTrajectoryFraction).
+			Str("controller", next.Mode).
+			Str("error-mode", next.ErrorMode).
+			Float32("heading-gain", next.HeadingGain).
+			Msg("Tuning changed")
+	}
+	tuning = next
+	return tuning, nil
+}
+
+// Converts a tuning state from the system manager to an update, options that are not in the state are left out
+func tuningUpdateFromState(state *pb_systemmanager_messages.TuningState) tuningUpdate {
+	update := tuningUpdate{}
+	floats := []struct {
+		name   string
+		target **float32
+	}{
+		{"kp", &update.Kp},
+		{"ki", &update.Ki},
+		{"kd", &update.Kd},
+		{"speed", &update.Speed},
+		{"desired-trajectory-fraction", &update.DesiredTrajectoryFraction},
+		{"heading-gain", &update.HeadingGain},
+	}
+	for _, option := range floats {
+		if value, err := servicerunner.GetTuningFloat(option.name, state); err == nil {
+			*option.target = &value
+		}
+	}
+	if value, err := servicerunner.GetTuningInt("desired-trajectory-point", state); err == nil {
+		update.DesiredTrajectoryPoint = &value
+	}
+	if value, err := servicerunner.GetTuningString("controller", state); err == nil {
+		update.Mode = &value
+	}
+	if value, err := servicerunner.GetTuningString("error-mode", state); err == nil {
+		update.ErrorMode = &value
+	}
+	return update
+}
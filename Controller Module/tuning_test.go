@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func float32Ptr(v float32) *float32 { return &v }
+func intPtr(v int) *int             { return &v }
+func stringPtr(v string) *string    { return &v }
+
+var testTuning = controllerTuning{
+	Kp:                        0.003,
+	Ki:                        0,
+	Kd:                        0.0005,
+	Speed:                     0.2,
+	DesiredTrajectoryFraction: 0.5,
+	Mode:                      "pid",
+	ErrorMode:                 errorModePixel,
+	HeadingGain:               0.5,
+}
+
+func TestApplyTuning(t *testing.T) {
+	tests := []struct {
+		name   string
+		update tuningUpdate
+		want   func(*controllerTuning) // changes to testTuning, nil if the update is rejected
+	}{
+		{"empty update", tuningUpdate{}, func(*controllerTuning) {}},
+		{"gains", tuningUpdate{Kp: float32Ptr(1), Ki: float32Ptr(0), Kd: float32Ptr(0.1)}, func(c *controllerTuning) { c.Kp, c.Ki, c.Kd = 1, 0, 0.1 }},
+		{"negative gain", tuningUpdate{Kd: float32Ptr(-0.1)}, nil},
+		{"gain above 1", tuningUpdate{Ki: float32Ptr(1.1)}, nil},
+		{"speed", tuningUpdate{Speed: float32Ptr(0.5)}, func(c *controllerTuning) { c.Speed = 0.5 }},
+		{"speed above 0.5", tuningUpdate{Speed: float32Ptr(0.6)}, nil},
+		{"negative speed", tuningUpdate{Speed: float32Ptr(-0.1)}, nil},
+		{"fraction", tuningUpdate{DesiredTrajectoryFraction: float32Ptr(0.25)}, func(c *controllerTuning) { c.DesiredTrajectoryFraction = 0.25 }},
+		{"fraction above 1", tuningUpdate{DesiredTrajectoryFraction: float32Ptr(1.5)}, nil},
+		{"negative fraction", tuningUpdate{DesiredTrajectoryFraction: float32Ptr(-0.5)}, nil},
+		{"deprecated point", tuningUpdate{DesiredTrajectoryPoint: intPtr(160)}, func(c *controllerTuning) { c.DesiredTrajectoryFraction = 0.25 }},
+		{"deprecated point at the right edge", tuningUpdate{DesiredTrajectoryPoint: intPtr(640)}, func(c *controllerTuning) { c.DesiredTrajectoryFraction = 1 }},
+		{"deprecated point beyond 640", tuningUpdate{DesiredTrajectoryPoint: intPtr(641)}, nil},
+		{"negative deprecated point", tuningUpdate{DesiredTrajectoryPoint: intPtr(-1)}, nil},
+		{"fraction wins over the deprecated point", tuningUpdate{DesiredTrajectoryFraction: float32Ptr(0.75), DesiredTrajectoryPoint: intPtr(160)}, func(c *controllerTuning) { c.DesiredTrajectoryFraction = 0.75 }},
+		{"mpc", tuningUpdate{Mode: stringPtr("mpc")}, func(c *controllerTuning) { c.Mode = "mpc" }},
+		{"unknown controller", tuningUpdate{Mode: stringPtr("lqr")}, nil},
+		{"controller names are case sensitive", tuningUpdate{Mode: stringPtr("PID")}, nil},
+		{"normalized error", tuningUpdate{ErrorMode: stringPtr(errorModeNormalized)}, func(c *controllerTuning) { c.ErrorMode = errorModeNormalized }},
+		{"unknown error mode", tuningUpdate{ErrorMode: stringPtr("meters")}, nil},
+		{"heading gain", tuningUpdate{HeadingGain: float32Ptr(2)}, func(c *controllerTuning) { c.HeadingGain = 2 }},
+		{"heading gain above 2", tuningUpdate{HeadingGain: float32Ptr(2.5)}, nil},
+		// Either all values are changed or none
+		{"valid gain with an invalid speed", tuningUpdate{Kp: float32Ptr(0.5), Speed: float32Ptr(1)}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tuning = testTuning
+			got, err := applyTuning(test.update, "test")
+			want := testTuning
+			if test.want == nil {
+				if err == nil {
+					t.Error("the update was accepted")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("the update was rejected: %v", err)
+				}
+				test.want(&want)
+			}
+			if got != want || currentTuning() != want {
+				t.Errorf("got %+v, want %+v", currentTuning(), want)
+			}
+		})
+	}
+}
+
+// The tuning API uses the names of the options in service.yaml
+func TestTuningNamesMatchServiceOptions(t *testing.T) {
+	service, err := os.ReadFile("service.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]json.RawMessage{}
+	encoded, _ := json.Marshal(testTuning)
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		t.Fatal(err)
+	}
+	for name := range values {
+		if !strings.Contains(strings.ReplaceAll(string(service), "\r", ""), "- name: "+name+"\n") {
+			t.Errorf("%s is not an option in service.yaml", name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// Where the frames come from, a gocv.VideoCapture or a mock camera (see mockcamera.go)
+type frameSource interface {
+	Read(m *gocv.Mat) bool
+	Close() error
+}
+
+// Opens a (new) frame source, the capture calls it again to reopen the camera after repeated failures
+type sourceOpener func() (frameSource, error)
+
+// Set in the Flags of the CameraSensorOutput while the camera does not deliver frames, the message then has
+// no trajectory points. Keep this in sync with the controller.
+const flagCameraUnhealthy = uint32(1 << 0)
+
+const (
+	// Consecutive failed reads before the camera is reported as unhealthy
+	unhealthyAfterFailures = 5
+	// Waiting time after the first failed read, it doubles with every failure up to maxCameraBackoff
+	minCameraBackoff = 10 * time.Millisecond
+	maxCameraBackoff = time.Second
+	// How often the detection reports an unhealthy camera when there are no frames
+	unhealthyReportInterval = 100 * time.Millisecond
+)
+
+// Opens the gstreamer pipeline (or any other source OpenCV understands)
+func openVideoCapture(pipeline string) sourceOpener {
+	return func() (frameSource, error) {
+		cam, err := gocv.OpenVideoCapture(pipeline)
+		if err != nil {
+			return nil, err
+		}
+		if !cam.IsOpened() {
+			cam.Close()
+			return nil, fmt.Errorf("failed to open video capture %q", pipeline)
+		}
+		return cam, nil
+	}
+}
+
+// Tracks the failed reads of the camera, only used by the capture goroutine except for the healthy flag
+type cameraHealth struct {
+	failures    int // consecutive failed reads
+	reopenAfter int // consecutive failed reads before the camera is reopened, 0 never reopens it
+	healthy     atomic.Bool
+}
+
+func newCameraHealth(reopenAfter int) *cameraHealth {
+	h := &cameraHealth{reopenAfter: reopenAfter}
+	h.healthy.Store(true)
+	cameraHealthy.set(1)
+	return h
+}
+
+func (h *cameraHealth) succeeded() {
+	if h.failures >= unhealthyAfterFailures {
+		log.Info().Int("failures", h.failures).Msg("Camera delivers frames again")
+	}
+	h.failures = 0
+	h.healthy.Store(true)
+	cameraHealthy.set(1)
+}
+
+// Registers a failed read, returns how long to wait before the next read and whether to reopen the camera first
+func (h *cameraHealth) failed() (time.Duration, bool) {
+	h.failures++
+	cameraFailures.inc()
+	if h.failures == 1 {
+		log.Warn().Msg("Error reading from camera")
+	}
+	if h.failures == unhealthyAfterFailures {
+		log.Error().Int("failures", h.failures).Msg("Camera is unhealthy")
+		h.healthy.Store(false)
+		cameraHealthy.set(0)
+	}
+
+	backoff := maxCameraBackoff
+	if shift := h.failures - 1; shift < 10 {
+		backoff = min(minCameraBackoff<<shift, maxCameraBackoff)
+	}
+	reopen := h.reopenAfter > 0 && h.failures%h.reopenAfter == 0
+	return backoff, reopen
+}
+
+// Closes the source (if any) and opens a new one, returns nil if that failed
+func reopenSource(source frameSource, open sourceOpener) frameSource {
+	if source != nil {
+		source.Close()
+	}
+	cameraReopens.inc()
+	source, err := open()
+	if err != nil {
+		log.Err(err).Msg("Failed to reopen the camera")
+		return nil
+	}
+	log.Info().Msg("Reopened the camera")
+	return source
+}
+
+// Waits for the given time, returns false if the service stopped in the meantime
+func waitOrStop(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stopping:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Publishes a message without trajectory that flags the camera as unhealthy, so the controller stops the rover
+func publishCameraUnhealthy(sock *zmq.Socket, output *frameOutput) error {
+	outputBytes, err := output.marshalCameraUnhealthy(time.Now())
+	if err != nil {
+		return err
+	}
+	outputBytes = output.extend(frameExtension{})
+	_, err = sock.SendBytes(outputBytes, 0)
+	return err
+}
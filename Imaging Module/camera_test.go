@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func TestCameraHealth(t *testing.T) {
+	health := newCameraHealth(3)
+	wantBackoff := minCameraBackoff
+	for i := 1; i <= 6; i++ {
+		backoff, reopen := health.failed()
+		if backoff != wantBackoff {
+			t.Errorf("failure %d: backoff %v, want %v", i, backoff, wantBackoff)
+		}
+		wantBackoff = min(2*wantBackoff, maxCameraBackoff)
+		if reopen != (i%3 == 0) {
+			t.Errorf("failure %d: reopen %v", i, reopen)
+		}
+		if healthy := health.healthy.Load(); healthy != (i < unhealthyAfterFailures) {
+			t.Errorf("failure %d: healthy %v", i, healthy)
+		}
+	}
+
+	health.succeeded()
+	if !health.healthy.Load() || health.failures != 0 {
+		t.Errorf("not recovered after a good read: healthy %v, failures %d", health.healthy.Load(), health.failures)
+	}
+	if _, reopen := health.failed(); reopen {
+		t.Error("reopened on the first failure after recovering")
+	}
+}
+
+func TestCameraHealthBackoffIsCapped(t *testing.T) {
+	health := newCameraHealth(0)
+	for i := 0; i < 100; i++ {
+		backoff, reopen := health.failed()
+		if backoff > maxCameraBackoff {
+			t.Fatalf("failure %d: backoff %v is above %v", i+1, backoff, maxCameraBackoff)
+		}
+		if reopen {
+			t.Fatalf("failure %d: reopened with reopening disabled", i+1)
+		}
+	}
+}
+
+func TestMockCameraFlaky(t *testing.T) {
+	source, err := openMockCamera("flaky", 64, 48, 1_000_000)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	frame := gocv.NewMat()
+	defer frame.Close()
+
+	for i := 0; i < mockFlakyFrames; i++ {
+		if !source.Read(&frame) {
+			t.Fatalf("read %d failed before the first failure", i)
+		}
+	}
+	for i := 0; i < mockFlakyFailures; i++ {
+		if source.Read(&frame) {
+			t.Fatalf("read %d of the failures succeeded", i)
+		}
+	}
+	if !source.Read(&frame) {
+		t.Fatal("the camera did not recover after the failures")
+	}
+}
+
+// A camera that fails a number of reads, it survives being closed and reopened so the failures carry over
+type failingCamera struct {
+	frame        gocv.Mat
+	failing      int
+	health       *cameraHealth
+	closes       atomic.Int32
+	sawUnhealthy atomic.Bool // whether the camera was reported unhealthy when the first read succeeded
+}
+
+func (c *failingCamera) Read(m *gocv.Mat) bool {
+	if c.failing > 0 {
+		c.failing--
+		return false
+	}
+	if c.failing == 0 {
+		c.sawUnhealthy.Store(!c.health.healthy.Load())
+		c.failing = -1
+	}
+	c.frame.CopyTo(m)
+	return true
+}
+
+func (c *failingCamera) Close() error {
+	c.closes.Add(1)
+	return nil
+}
+
+func TestCaptureRecoversFromFailingCamera(t *testing.T) {
+	health := newCameraHealth(3)
+	camera := &failingCamera{
+		frame:   gocv.NewMatWithSize(48, 64, gocv.MatTypeCV8UC3),
+		failing: unhealthyAfterFailures,
+		health:  health,
+	}
+	defer camera.frame.Close()
+	opens := atomic.Int32{}
+	open := func() (frameSource, error) {
+		opens.Add(1)
+		return camera, nil
+	}
+	failures, reopens := cameraFailures.value(), cameraReopens.value()
+
+	// The capture runs until the service stops, stop this one at the end of the test
+	serviceStopping := stopping
+	stopping = make(chan struct{})
+	latest, free, done := startCapture(camera, open, health)
+	defer func() {
+		close(stopping)
+		<-done
+		releaseFrames(latest, free)
+		stopping = serviceStopping
+	}()
+
+	select {
+	case frame := <-latest:
+		free <- frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame after the camera recovered")
+	}
+
+	if !camera.sawUnhealthy.Load() {
+		t.Errorf("the camera was not reported unhealthy after %d failed reads", unhealthyAfterFailures)
+	}
+	if !health.healthy.Load() {
+		t.Error("the camera is still unhealthy after a good read")
+	}
+	if got := cameraFailures.value() - failures; got != unhealthyAfterFailures {
+		t.Errorf("%v failed reads counted, want %d", got, unhealthyAfterFailures)
+	}
+	// Reopened once, after the third failure
+	if got := opens.Load(); got != 1 {
+		t.Errorf("opened %d times, want 1", got)
+	}
+	if got := camera.closes.Load(); got != 1 {
+		t.Errorf("closed %d times before the reopen, want 1", got)
+	}
+	if got := cameraReopens.value() - reopens; got != 1 {
+		t.Errorf("%v reopens counted, want 1", got)
+	}
+}
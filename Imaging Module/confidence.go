@@ -0,0 +1,71 @@
+package main
+
+import "math"
+
+// Scores how much a detected lane can be trusted, from 0 (noise) to 1. The score combines:
+//
+//	width       the width of the run compared to the expected lane width (see lanewidth.go), a 2 pixel run is not a lane.
+//	            A lane that was inferred from one edge scores at most 0.5
+//	competitors other runs in the row that are at least half as wide, any of them could be the lane
+//	temporal    how far the lane center moved since the previous frame
+//	boundary    how far the boundary (the end of the lane ahead, found by the vertical scan) moved since the previous frame
+//
+// The width score multiplies the mean of the others, so a run of the wrong width is never trusted.
+type confidenceEstimator struct {
+	center   float64 // lane center of the previous frame as a fraction of the image width, -1 if there is none
+	boundary float64 // boundary of the previous frame as a fraction of the image height, -1 if there is none
+}
+
+// A lane center or boundary that moves this fraction of the image between two frames scores 0
+const (
+	maxCenterShift   = 0.1
+	maxBoundaryShift = 0.1
+)
+
+func newConfidenceEstimator() *confidenceEstimator {
+	return &confidenceEstimator{center: -1, boundary: -1}
+}
+
+// Scores the lane found among the runs of a row of a width x height frame, expectedWidth is the expected lane width
+// in that row in pixels. boundary is the row found by the vertical scan, -1 if the detection has none.
+func (c *confidenceEstimator) score(lane SliceDescriptor, runs []SliceDescriptor, expectedWidth float64, width int, height int, boundary int) float32 {
+	laneWidth := lane.End - lane.Start + 1
+	ratio := float64(laneWidth) / expectedWidth
+	widthScore := max(1-math.Abs(ratio-1), 0)
+	if lane.Start < 0 || lane.End >= width {
+		// Only one edge was seen
+		widthScore = min(widthScore, 0.5)
+	}
+
+	competitors := 0
+	for _, run := range runs {
+		if run != lane && 2*(run.End-run.Start+1) >= laneWidth {
+			competitors++
+		}
+	}
+	competitorScore := 1 / float64(1+competitors)
+
+	center := float64(lane.Start+lane.End) / 2 / float64(width)
+	temporalScore := 1.0
+	if c.center >= 0 {
+		temporalScore = max(1-math.Abs(center-c.center)/maxCenterShift, 0)
+	}
+	c.center = center
+
+	boundaryScore := 1.0
+	if boundary >= 0 {
+		row := float64(boundary) / float64(height)
+		if c.boundary >= 0 {
+			boundaryScore = max(1-math.Abs(row-c.boundary)/maxBoundaryShift, 0)
+		}
+		c.boundary = row
+	}
+
+	return float32(widthScore * (competitorScore + temporalScore + boundaryScore) / 3)
+}
+
+// Forgets the previous frame, call this when no lane was found
+func (c *confidenceEstimator) lost() {
+	c.center = -1
+	c.boundary = -1
+}
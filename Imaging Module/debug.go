@@ -0,0 +1,190 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+	"golang.org/x/sys/unix"
+)
+
+// Jobs in flight: one waiting, one being encoded and one being filled by the detection
+const debugJobs = 3
+
+// Nice value of the encoder thread, so the kernel schedules the detection first
+const debugNice = 10
+
+// A request to draw and encode a debug frame, the mask is a copy so the detection can go on
+type debugJob struct {
+	mask     gocv.Mat
+	lane     SliceDescriptor
+	row      int
+	boundary int       // boundary detected in the middle column, -1 if there is none
+	captured time.Time // wall clock time the frame was read
+}
+
+// An encoded debug frame and the lane that is drawn on it
+type debugFrame struct {
+	jpeg     []byte
+	lane     SliceDescriptor
+	row      int
+	width    int
+	height   int
+	captured time.Time
+}
+
+// Draws and encodes debug frames in the background and publishes them on the debug output, so the trajectory
+// never waits for the JPEG encoding. The socket is only used by the encoder goroutine.
+type debugEncoder struct {
+	jobs    chan *debugJob
+	free    chan *debugJob
+	quality   int
+	imagePath string // file the latest debug frame is written to, empty to not write it
+	sock      *zmq.Socket
+	output    *debugOutput
+	done      chan struct{} // closed when the encoder stopped
+}
+
+func startDebugEncoder(sock *zmq.Socket, quality int, imagePath string) *debugEncoder {
+	e := &debugEncoder{
+		jobs:      make(chan *debugJob, 1),
+		free:      make(chan *debugJob, debugJobs),
+		quality:   quality,
+		imagePath: imagePath,
+		sock:      sock,
+		output:    newDebugOutput(),
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < debugJobs; i++ {
+		e.free <- &debugJob{mask: gocv.NewMat()}
+	}
+	go e.run()
+	return e
+}
+
+// Hands the mask and the detected lane to the encoder, a job that is still waiting is dropped for this one
+func (e *debugEncoder) offer(mask *gocv.Mat, lane SliceDescriptor, row int, boundary int, captured time.Time) {
+	var job *debugJob
+	select {
+	case job = <-e.free:
+	default:
+		debugFramesDropped.inc()
+		return
+	}
+	mask.CopyTo(&job.mask)
+	job.lane = lane
+	job.row = row
+	job.boundary = boundary
+	job.captured = captured
+	if offerLatest(e.jobs, job, e.free) {
+		debugFramesDropped.inc()
+	}
+}
+
+// Stops the encoder after the jobs that are waiting and releases the Mats. offer must not be called afterwards.
+func (e *debugEncoder) stop() {
+	close(e.jobs)
+	<-e.done
+	for i := 0; i < debugJobs; i++ {
+		job := <-e.free
+		job.mask.Close()
+	}
+}
+
+func (e *debugEncoder) run() {
+	defer close(e.done)
+	// Lower the priority of this thread only, the detection runs on other threads
+	runtime.LockOSThread()
+	if err := unix.Setpriority(unix.PRIO_PROCESS, unix.Gettid(), debugNice); err != nil {
+		log.Warn().Err(err).Msg("Failed to lower the priority of the debug encoder")
+	}
+
+	debug := gocv.NewMat()
+	defer debug.Close()
+	// used for JPEG compression
+	compressionParams := []int{gocv.IMWriteJpegQuality, e.quality}
+	frame := debugFrame{}
+
+	for job := range e.jobs {
+		started := time.Now()
+		gocv.CvtColor(job.mask, &debug, gocv.ColorGrayToBGR)
+		frame.lane = job.lane
+		frame.row = job.row
+		frame.width = job.mask.Cols()
+		frame.height = job.mask.Rows()
+		frame.captured = job.captured
+		drawLookahead(&debug, job)
+		e.free <- job
+
+		if e.imagePath != "" && !gocv.IMWrite(e.imagePath, debug) {
+			log.Debug().Str("path", e.imagePath).Msg("Failed to write the debug image")
+		}
+
+		// Convert the image to JPEG bytes
+		imgBytes, err := gocv.IMEncodeWithParams(".jpg", debug, compressionParams)
+		if err != nil {
+			log.Err(err).Msg("Error encoding image")
+			continue
+		}
+		frame.jpeg = imgBytes.GetBytes()
+		outputBytes, err := e.output.marshal(&frame)
+		imgBytes.Close() // the bytes are copied into the message
+		frame.jpeg = nil
+		if err != nil {
+			log.Err(err).Msg("Error marshalling debug frame")
+			continue
+		}
+		debugEncodeTime.set(float64(time.Since(started)) / float64(time.Millisecond))
+
+		_, err = e.sock.SendBytes(outputBytes, 0)
+		if err != nil {
+			log.Err(err).Msg("Error sending debug frame")
+			debugFramesDropped.inc()
+			continue
+		}
+		debugFramesSent.inc()
+	}
+}
+
+// Draws the lane slice and the error to the middle of the image, and the lookahead if a boundary was detected
+func drawLookahead(debug *gocv.Mat, job *debugJob) {
+	lane := job.lane
+	rowIndex := job.row
+	middleX := debug.Cols() / 2
+
+	//Horizontal points
+	startPoint := image.Pt(lane.Start, rowIndex)
+	endPoint := image.Pt(lane.End, rowIndex)
+	ErrorPoint := image.Pt((lane.Start+lane.End)/2, rowIndex)
+	middePoint := image.Pt(middleX, rowIndex)
+
+	//Horizontal lines
+	if (lane.Start+lane.End)/2 <= middleX {
+		gocv.Line(debug, startPoint, ErrorPoint, color.RGBA{R: 128, G: 133, B: 133, A: 0}, 1)
+		gocv.Line(debug, ErrorPoint, middePoint, color.RGBA{R: 255, G: 0, B: 0, A: 0}, 2) // Error
+		gocv.Line(debug, middePoint, endPoint, color.RGBA{R: 128, G: 133, B: 133, A: 0}, 1)
+	} else {
+		gocv.Line(debug, startPoint, middePoint, color.RGBA{R: 128, G: 133, B: 133, A: 0}, 1)
+		gocv.Line(debug, middePoint, ErrorPoint, color.RGBA{R: 255, G: 0, B: 0, A: 0}, 2) // Error
+		gocv.Line(debug, ErrorPoint, endPoint, color.RGBA{R: 128, G: 133, B: 133, A: 0}, 1)
+	}
+
+	if job.boundary < 0 {
+		return
+	}
+
+	//Vertical points
+	VstartPoint1 := image.Pt(middleX, job.boundary)
+	VendPoint := image.Pt(middleX, debug.Rows())
+	VrowIndexPoint := image.Pt(middleX, rowIndex)
+
+	//Vertical lines
+	gocv.Line(debug, VstartPoint1, VrowIndexPoint, color.RGBA{R: 128, G: 133, B: 133, A: 0}, 1)
+	gocv.Line(debug, VendPoint, VrowIndexPoint, color.RGBA{R: 0, G: 255, B: 0, A: 0}, 2) //height
+
+	gocv.Circle(debug, VstartPoint1, 5, color.RGBA{R: 220, G: 0, B: 200, A: 0}, -1)
+}
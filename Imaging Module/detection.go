@@ -0,0 +1,138 @@
+package main
+
+import (
+	"image"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// Picks the row to steer on and the lane in it, this is where Dynamic-Lookahead.go and Static-Lookahead.go differ
+type laneFinder interface {
+	// Returns the lane, or nil if there is none, the row it is in and the runs of that row the lane was picked from.
+	// The boundary is the end of the lane ahead found by the vertical scan. The lane and the runs point into buffers
+	// of the finder, they are only valid until the next call.
+	find(pixels grayImage, widths *laneWidthModel) (lane *SliceDescriptor, row int, boundary int, runs []SliceDescriptor)
+}
+
+// The detection of a frame, from the camera image to the message on the path output. Both variants and
+// BenchmarkPipeline run it, all buffers are reused so it does not allocate once they are sized.
+type laneDetector struct {
+	finder     laneFinder
+	widths     *laneWidthModel
+	confidence *confidenceEstimator
+	obstacles  obstacleDetector
+	// The message sent for every frame
+	output *frameOutput
+	// Stage timestamps of the current frame, sent along with it
+	timer frameTimer
+	// The Mats below are reused for every frame, OpenCV only reallocates them when the image size changes
+	// The (thresholded) grayscale image, which is scanned for the lane
+	mask gocv.Mat
+	// Kernel for the dilation and erosion
+	kernel gocv.Mat
+	// Buffers for the scans, reused between frames
+	nearRuns   []SliceDescriptor
+	trajectory []trajectoryPoint
+}
+
+// The result of the detection of a frame
+type detection struct {
+	found    bool // whether a lane was found, lane, row and boundary are only set if so
+	lane     SliceDescriptor
+	row      int
+	boundary int
+	message  []byte // the message for the path output, also for a frame without a lane. Only valid until the next frame
+}
+
+func newLaneDetector(finder laneFinder, widths *laneWidthModel, detectObstacles bool) *laneDetector {
+	return &laneDetector{
+		finder:     finder,
+		widths:     widths,
+		confidence: newConfidenceEstimator(),
+		obstacles:  obstacleDetector{enabled: detectObstacles},
+		output:     newFrameOutput(),
+		mask:       gocv.NewMat(),
+		kernel:     gocv.GetStructuringElement(gocv.MorphRect, image.Pt(5, 5)),
+	}
+}
+
+func (d *laneDetector) close() {
+	d.mask.Close()
+	d.kernel.Close()
+}
+
+// Detects the lane in a frame. The frame is handed back through free as soon as its Mat is no longer needed, the
+// image is only thresholded if threshold > 0. The message is built whether or not a lane was found.
+func (d *laneDetector) detect(frame *capturedFrame, free chan<- *capturedFrame, threshold int) (detection, error) {
+	d.timer.copyFrom(&frame.timer)
+	width := frame.mat.Cols()
+	height := frame.mat.Rows()
+	log.Debug().Int("width", width).Int("height", height).Msg("Read image")
+
+	// Convert the image to grayscale (for thresholding and scanning)
+	gocv.CvtColor(frame.mat, &d.mask, gocv.ColorBGRToGray)
+	free <- frame // the capture can reuse it
+	if threshold > 0 {
+		// Standard Thresholding Image segmentation
+		gocv.Threshold(d.mask, &d.mask, float32(threshold), 255.0, gocv.ThresholdBinary+gocv.ThresholdOtsu)
+		d.timer.mark("threshold")
+		gocv.Dilate(d.mask, &d.mask, d.kernel)
+		gocv.Erode(d.mask, &d.mask, d.kernel)
+		d.timer.mark("morphology")
+	}
+
+	pixels, err := newGrayImage(&d.mask)
+	if err != nil {
+		return detection{}, err
+	}
+
+	lane, row, boundary, runs := d.finder.find(pixels, d.widths)
+	if lane == nil {
+		laneLost.inc()
+		d.confidence.lost()
+		d.timer.mark("scan")
+		// Sent without trajectory points, so the controller stops instead of driving on its last decision
+		_, err = d.output.marshal(d.trajectory[:0], width, height, 0, d.timer.capturedAt)
+		if err != nil {
+			return detection{}, err
+		}
+		d.timer.mark("marshal")
+		return detection{message: d.output.extend(d.timer.extension)}, nil
+	}
+	lookaheadRow.set(float64(row))
+	var geometry laneGeometry
+	geometry, d.nearRuns = measureLane(pixels, *lane, row, d.nearRuns)
+	d.timer.extension.lane, d.timer.extension.hasLane = geometry, true
+	laneOffset.set(float64(geometry.offset))
+	laneHeading.set(float64(geometry.heading))
+	laneWidth.set(float64(geometry.width))
+	d.timer.extension.confidence = d.confidence.score(*lane, runs, d.widths.expected(row, width, height), width, height, boundary)
+	d.widths.learnFrom(*lane, row, width, height, d.timer.extension.confidence)
+	// Look for obstacles on the lane ahead, the controller stops before them
+	flags := uint32(0)
+	d.timer.extension.obstacle, d.timer.extension.hasObstacle = d.obstacles.detect(pixels, *lane, d.widths)
+	if d.timer.extension.hasObstacle {
+		flags |= flagObstacle
+		obstacleGauge.set(float64(d.timer.extension.obstacle))
+	} else {
+		obstacleGauge.set(-1)
+	}
+	laneConfidence.set(float64(d.timer.extension.confidence))
+	d.timer.mark("scan")
+
+	// Follow the lane towards the rover, the MPC plans on the whole trajectory
+	d.trajectory, d.nearRuns = traceLane(pixels, *lane, row, d.widths, d.nearRuns, d.trajectory[:0])
+	_, err = d.output.marshal(d.trajectory, width, height, flags, d.timer.capturedAt)
+	if err != nil {
+		return detection{}, err
+	}
+	d.timer.mark("marshal")
+	return detection{
+		found:    true,
+		lane:     *lane,
+		row:      row,
+		boundary: boundary,
+		message:  d.output.extend(d.timer.extension),
+	}, nil
+}
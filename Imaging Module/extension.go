@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Values that are not (yet) part of the communication definitions are appended to the marshalled SensorOutput
+// as a nested message, with a field number far outside the range used by the definitions. Receivers that
+// do not know the extension (the actuator, the web UI) skip it like any unknown field.
+//
+//	1000 frame extension
+//	  1  monotonic time (ns) before reading the frame
+//	  2  monotonic time (ns) the frame was read from the camera
+//	  3  repeated stage: 1 name, 2 monotonic time (ns) the stage ended
+//	  4  sequence number of the message on the path output, starts at 1
+//	  5  session, a random number picked when the imaging module starts
+//	  6  lateral offset of the lane, -1 and 1 are the image edges (float), only when a lane was found (see geometry.go)
+//	  7  heading of the lane in radians (float), only when a lane was found
+//	  8  width of the lane in pixels, only when a lane was found
+//	  9  confidence of the detection in [0,1] (float), only when a lane was found (see confidence.go)
+//	 10  distance of the obstacle on the lane as a fraction of the image height (float), only with flagObstacle (see obstacle.go)
+//
+// The controller reads the same layout, see its extension.go.
+const frameExtensionField = 1000
+
+// A processing stage of a frame and the monotonic time (ns) it ended
+type stageTime struct {
+	name string
+	end  int64
+}
+
+type frameExtension struct {
+	start       int64
+	capture     int64
+	stages      []stageTime
+	sequence    uint64
+	session     uint64
+	lane        laneGeometry
+	confidence  float32
+	hasLane     bool
+	obstacle    float32
+	hasObstacle bool
+}
+
+// Appends the extension to a marshalled SensorOutput. The nested messages are sized up front and written straight
+// into b, so a reused b does not allocate.
+func appendFrameExtension(b []byte, ext frameExtension) []byte {
+	b = protowire.AppendTag(b, frameExtensionField, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(frameExtensionSize(ext)))
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(ext.start))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(ext.capture))
+	for _, stage := range ext.stages {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(stageSize(stage)))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, stage.name)
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(stage.end))
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, ext.sequence)
+	b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, ext.session)
+	if ext.hasLane {
+		b = protowire.AppendTag(b, 6, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(ext.lane.offset))
+		b = protowire.AppendTag(b, 7, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(ext.lane.heading))
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ext.lane.width))
+		b = protowire.AppendTag(b, 9, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(ext.confidence))
+	}
+	if ext.hasObstacle {
+		b = protowire.AppendTag(b, 10, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(ext.obstacle))
+	}
+	return b
+}
+
+// Size in bytes of the nested extension message, without its tag and length
+func frameExtensionSize(ext frameExtension) int {
+	n := protowire.SizeTag(1) + protowire.SizeVarint(uint64(ext.start))
+	n += protowire.SizeTag(2) + protowire.SizeVarint(uint64(ext.capture))
+	for _, stage := range ext.stages {
+		n += protowire.SizeTag(3) + protowire.SizeBytes(stageSize(stage))
+	}
+	n += protowire.SizeTag(4) + protowire.SizeVarint(ext.sequence)
+	n += protowire.SizeTag(5) + protowire.SizeFixed64()
+	if ext.hasLane {
+		n += protowire.SizeTag(6) + protowire.SizeFixed32()
+		n += protowire.SizeTag(7) + protowire.SizeFixed32()
+		n += protowire.SizeTag(8) + protowire.SizeVarint(uint64(ext.lane.width))
+		n += protowire.SizeTag(9) + protowire.SizeFixed32()
+	}
+	if ext.hasObstacle {
+		n += protowire.SizeTag(10) + protowire.SizeFixed32()
+	}
+	return n
+}
+
+// Size in bytes of a nested stage message, without its tag and length
+func stageSize(stage stageTime) int {
+	return protowire.SizeTag(1) + protowire.SizeBytes(len(stage.name)) + protowire.SizeTag(2) + protowire.SizeVarint(uint64(stage.end))
+}
+
+// Monotonic clock in nanoseconds. Unlike the wall clock it does not jump, and it is the same clock
+// for all processes on the rover, so the controller can compare it with its own.
+func monotonicNow() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano()
+}
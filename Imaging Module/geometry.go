@@ -0,0 +1,102 @@
+package main
+
+import "math"
+
+// The lane in units that do not depend on the resolution or on where the camera is mounted, so the controller
+// can regulate it without retuning its gains for every camera
+type laneGeometry struct {
+	offset  float32 // lateral offset of the lane center from the image center, -1 is the left edge and 1 the right edge, beyond that for a lane inferred from one edge
+	heading float32 // angle of the lane in the image in radians, 0 is straight ahead and positive bends to the right
+	width   int     // width of the lane in the lookahead row in pixels, a lane that is much narrower or wider is suspect
+}
+
+// Rows between the lookahead row and the row below it that is used for the heading, on a 480 rows high frame
+const headingBaseline = 40
+
+// Measures the lane found in the given row. The heading is the angle between the centers of the lane in that row and
+// in a row closer to the rover. runs is the buffer for the scan of that row, it is returned so it can be reused.
+func measureLane(pixels grayImage, lane SliceDescriptor, row int, runs []SliceDescriptor) (laneGeometry, []SliceDescriptor) {
+	center := float32(lane.Start+lane.End) / 2
+	half := float32(pixels.width) / 2
+	geometry := laneGeometry{
+		offset: (center - half) / half,
+		width:  lane.End - lane.Start + 1,
+	}
+
+	nearRow := min(row+scaleRow(headingBaseline, pixels.height), pixels.height-1)
+	if nearRow <= row {
+		// The lookahead is the bottom row, there is nothing below it
+		return geometry, runs
+	}
+	runs = getConsecutiveWhitePointsFromSlice(pixels.row(nearRow), runs[:0])
+	near := closestRun(runs, center)
+	if near == nil {
+		return geometry, runs
+	}
+	nearCenter := float32(near.Start+near.End) / 2
+	geometry.heading = float32(math.Atan2(float64(center-nearCenter), float64(nearRow-row)))
+	return geometry, runs
+}
+
+// Returns the run whose center is closest to x, or nil if there are none
+func closestRun(runs []SliceDescriptor, x float32) *SliceDescriptor {
+	var closest *SliceDescriptor
+	closestDistance := float32(math.MaxFloat32)
+	for i := range runs {
+		distance := float32(runs[i].Start+runs[i].End)/2 - x
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance < closestDistance {
+			closest, closestDistance = &runs[i], distance
+		}
+	}
+	return closest
+}
+
+// A point of the published trajectory, x is the lane center in row y. x can be outside the image for a lane that was
+// inferred from one edge (see lanewidth.go).
+type trajectoryPoint struct {
+	x int
+	y int
+}
+
+// Number of rows in the published trajectory: the lookahead row first, then rows spread evenly towards the bottom
+// of the image, so the MPC in the controller has a path to plan on
+const trajectoryRows = 4
+
+// Follows the lane found in the lookahead row down towards the rover and appends its center in every trajectory row
+// to trajectory. Each row takes the run closest to the center in the row above it, a row without a run within the
+// expected lane width of that center ends the trajectory. runs is the buffer for the scans, it is returned so it can
+// be reused.
+func traceLane(pixels grayImage, lane SliceDescriptor, row int, widths *laneWidthModel, runs []SliceDescriptor, trajectory []trajectoryPoint) ([]trajectoryPoint, []SliceDescriptor) {
+	center := (lane.Start + lane.End) / 2
+	trajectory = append(trajectory, trajectoryPoint{x: center, y: row})
+
+	spacing := (pixels.height - 1 - row) / (trajectoryRows - 1)
+	if spacing <= 0 {
+		return trajectory, runs
+	}
+	for i := 1; i < trajectoryRows; i++ {
+		y := row + i*spacing
+		runs = getConsecutiveWhitePointsFromSlice(pixels.row(y), runs[:0])
+		next := closestRun(runs, float32(center))
+		if next == nil {
+			break
+		}
+		nextCenter := (next.Start + next.End) / 2
+		if float64(abs(nextCenter-center)) > widths.expected(y, pixels.width, pixels.height) {
+			break
+		}
+		center = nextCenter
+		trajectory = append(trajectory, trajectoryPoint{x: center, y: y})
+	}
+	return trajectory, runs
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+
+	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
+	servicerunner "github.com/VU-ASE/pkg-ServiceRunner/v2/src"
+	"github.com/rs/zerolog/log"
+)
+
+// The expected width of the lane in a row, a linear function of y for the perspective: the lane is widest at the bottom
+// of the image, closest to the rover. The widths are fractions of the image width, so they hold for any resolution.
+// With learning on, confident detections slowly move the widths towards what the camera actually sees.
+type laneWidthModel struct {
+	top       float64 // expected width in the top row, as a fraction of the image width
+	bottom    float64 // expected width in the bottom row, as a fraction of the image width
+	tolerance float64 // runs whose width differs more than this fraction from the expected width are rejected
+	learn     bool
+}
+
+const (
+	// Only detections that are at least this confident (see confidence.go) are learned from
+	learnConfidence = 0.8
+	// How far each learned detection moves the widths towards its own width
+	learnRate = 0.02
+	// The learned widths stay within these bounds, as a fraction of the image width
+	minLearnedWidth = 0.01
+	maxLearnedWidth = 1
+)
+
+// Reads the lane-width-top, lane-width-bottom, lane-width-tolerance and learn-lane-width options
+func laneWidthModelFromTuning(tuning *pb_systemmanager_messages.TuningState) (*laneWidthModel, error) {
+	m := &laneWidthModel{}
+	options := []struct {
+		name  string
+		value *float64
+	}{
+		{"lane-width-top", &m.top},
+		{"lane-width-bottom", &m.bottom},
+		{"lane-width-tolerance", &m.tolerance},
+	}
+	for _, option := range options {
+		value, err := servicerunner.GetTuningFloat(option.name, tuning)
+		if err != nil {
+			log.Err(err).Str("option", option.name).Msg("Failed to get the lane width from tuning. Is it defined in service.yaml?")
+			return nil, err
+		}
+		*option.value = float64(value)
+	}
+	learn, err := servicerunner.GetTuningInt("learn-lane-width", tuning)
+	if err != nil {
+		return nil, err
+	}
+	m.learn = learn != 0
+
+	if m.top <= 0 || m.top > 1 || m.bottom <= 0 || m.bottom > 1 {
+		return nil, fmt.Errorf("lane-width-top and lane-width-bottom must be fractions of the image width between 0 and 1, got %f and %f", m.top, m.bottom)
+	}
+	if m.tolerance <= 0 || m.tolerance >= 1 {
+		return nil, fmt.Errorf("lane-width-tolerance must be between 0 and 1, got %f", m.tolerance)
+	}
+	log.Info().Float64("top", m.top).Float64("bottom", m.bottom).Float64("tolerance", m.tolerance).Bool("learn", m.learn).Msg("Expected lane width")
+	return m, nil
+}
+
+// Where row y lies between the top (0) and the bottom (1) of a frame of the given height
+func rowPosition(y int, height int) float64 {
+	return float64(y) / float64(max(height-1, 1))
+}
+
+// Expected lane width in pixels in row y of a width x height frame
+func (m *laneWidthModel) expected(y int, width int, height int) float64 {
+	position := rowPosition(y, height)
+	return (m.top + (m.bottom-m.top)*position) * float64(width)
+}
+
+// Keeps the runs of row y that can be the lane, runs is filtered in place. A run that is cut off by the side of the
+// image shows only one edge of the lane. When it is narrower than expected it is completed to the expected width from
+// that edge, so its center is the edge plus (or minus) half the expected width. Such a run extends beyond the image.
+// Completed runs are only kept when no other run is fully visible: a completed sliver is exactly as wide as expected,
+// so it would beat a fully visible lane that is a bit narrower when the longest run is picked.
+func (m *laneWidthModel) gate(runs []SliceDescriptor, y int, width int, height int) []SliceDescriptor {
+	expected := m.expected(y, width, height)
+	low, high := expected*(1-m.tolerance), expected*(1+m.tolerance)
+
+	kept := runs[:0]
+	visible := false
+	for _, run := range runs {
+		runWidth := float64(run.End - run.Start + 1)
+		leftCut, rightCut := run.Start == 0, run.End == width-1
+		if runWidth > high {
+			// Glare or the whole floor
+			runsRejected.inc()
+			continue
+		}
+		if runWidth < low {
+			switch {
+			case leftCut && !rightCut:
+				run.Start = run.End - int(expected) + 1
+			case rightCut && !leftCut:
+				run.End = run.Start + int(expected) - 1
+			default:
+				runsRejected.inc()
+				continue
+			}
+		} else {
+			visible = true
+		}
+		kept = append(kept, run)
+	}
+
+	gated := kept[:0]
+	for _, run := range kept {
+		if run.Start < 0 || run.End >= width {
+			if visible {
+				runsRejected.inc()
+				continue
+			}
+			lanesInferred.inc()
+		}
+		gated = append(gated, run)
+	}
+	laneExpected.set(expected)
+	return gated
+}
+
+// Moves the expected widths towards the width of a lane found in row y, if learning is on and the detection is
+// confident. Lanes that touch the side of the image are not learned from, their width is not known.
+func (m *laneWidthModel) learnFrom(lane SliceDescriptor, y int, width int, height int, confidence float32) {
+	if !m.learn || confidence < learnConfidence || lane.Start <= 0 || lane.End >= width-1 {
+		return
+	}
+	position := rowPosition(y, height)
+	err := float64(lane.End-lane.Start+1)/float64(width) - (m.top + (m.bottom-m.top)*position)
+	m.top = min(max(m.top+learnRate*err*(1-position), minLearnedWidth), maxLearnedWidth)
+	m.bottom = min(max(m.bottom+learnRate*err*position, minLearnedWidth), maxLearnedWidth)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLaneWidthGate(t *testing.T) {
+	// 100 pixels wide frames, the lane is expected to be 40 pixels wide in every row, 20 to 60 is accepted
+	widths := laneWidthModel{top: 0.4, bottom: 0.4, tolerance: 0.5}
+	tests := []struct {
+		name string
+		runs []SliceDescriptor
+		want []SliceDescriptor
+	}{
+		{"lane", []SliceDescriptor{{30, 69}}, []SliceDescriptor{{30, 69}}},
+		{"too narrow", []SliceDescriptor{{30, 39}}, []SliceDescriptor{}},
+		{"too wide", []SliceDescriptor{{0, 99}}, []SliceDescriptor{}},
+		{"cut by the left side", []SliceDescriptor{{0, 9}}, []SliceDescriptor{{-30, 9}}},
+		{"cut by the right side", []SliceDescriptor{{90, 99}}, []SliceDescriptor{{90, 129}}},
+		{"cut at one side but wide enough", []SliceDescriptor{{0, 29}}, []SliceDescriptor{{0, 29}}},
+		// A completed sliver is as wide as expected and would be picked as the longest run
+		{"visible lane beats a sliver", []SliceDescriptor{{0, 5}, {40, 65}}, []SliceDescriptor{{40, 65}}},
+		{"visible lane beats slivers on both sides", []SliceDescriptor{{0, 5}, {40, 65}, {95, 99}}, []SliceDescriptor{{40, 65}}},
+		{"slivers on both sides", []SliceDescriptor{{0, 5}, {95, 99}}, []SliceDescriptor{{-34, 5}, {95, 134}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := widths.gate(test.runs, 50, 100, 100)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMeasureLaneInferredOffset(t *testing.T) {
+	// A lane completed from the right edge of a 100 pixels wide image has its center beyond the left edge
+	pixels := grayImage{data: make([]byte, 100), step: 100, width: 100, height: 1}
+	geometry, _ := measureLane(pixels, SliceDescriptor{Start: -51, End: 9}, 0, nil)
+	if want := float32(-1.42); geometry.offset > want+1e-6 || geometry.offset < want-1e-6 {
+		t.Errorf("offset %f, want %f", geometry.offset, want)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// Counters and gauges served on /metrics in the Prometheus text format, so a track session can be scraped
+var (
+	framesProcessed = newMetric("rover_imaging_frames_processed_total", "counter", "Frames processed and published")
+	framesDropped   = newMetric("rover_imaging_frames_dropped_total", "counter", "Frames that were not published, because the camera read failed, a newer frame was read before it was processed or it could not be processed")
+	emptySlices     = newMetric("rover_imaging_empty_slices_total", "counter", "Scanned rows without any white pixels")
+	laneLost        = newMetric("rover_imaging_lane_lost_total", "counter", "Frames in which no lane was found")
+	lookaheadRow    = newMetric("rover_imaging_lookahead_row", "gauge", "Image row used for the trajectory")
+	imagingFps      = newMetric("rover_imaging_fps", "gauge", "Published frames per second, smoothed over a few frames")
+	cameraFailures  = newMetric("rover_imaging_camera_failures_total", "counter", "Failed reads from the camera")
+	cameraReopens   = newMetric("rover_imaging_camera_reopens_total", "counter", "Times the camera was reopened after repeated failures")
+	cameraHealthy   = newMetric("rover_imaging_camera_healthy", "gauge", "1 while the camera delivers frames, 0 after repeated failures")
+
+	debugFramesSent    = newMetric("rover_imaging_debug_frames_sent_total", "counter", "Debug frames published on the debug output")
+	debugFramesDropped = newMetric("rover_imaging_debug_frames_dropped_total", "counter", "Debug frames that were skipped because the encoder was busy or sending failed")
+	debugEncodeTime    = newMetric("rover_imaging_debug_encode_ms", "gauge", "Time to draw and encode the last debug frame in milliseconds")
+
+	laneOffset     = newMetric("rover_imaging_lane_offset", "gauge", "Lateral offset of the lane from the image center, -1 is the left edge and 1 the right edge")
+	laneHeading    = newMetric("rover_imaging_lane_heading_radians", "gauge", "Angle of the lane in the image, positive bends to the right")
+	laneWidth      = newMetric("rover_imaging_lane_width_pixels", "gauge", "Width of the lane in the lookahead row")
+	laneConfidence = newMetric("rover_imaging_lane_confidence", "gauge", "Confidence of the detection in the last frame, from 0 (noise) to 1")
+	laneExpected   = newMetric("rover_imaging_lane_expected_width_pixels", "gauge", "Expected width of the lane in the lookahead row")
+	runsRejected   = newMetric("rover_imaging_runs_rejected_total", "counter", "White runs that were too narrow or too wide to be the lane")
+	lanesInferred  = newMetric("rover_imaging_lanes_inferred_total", "counter", "Lanes that were cut off by the side of the image and inferred from one edge")
+	obstacleGauge  = newMetric("rover_imaging_obstacle_distance", "gauge", "Distance of the obstacle on the lane as a fraction of the image height, -1 when there is none")
+
+	// Updated when the metrics are served, so a leak shows up as a growing heap or Mat count
+	heapBytes   = newMetric("rover_imaging_heap_bytes", "gauge", "Bytes of allocated Go heap objects")
+	heapObjects = newMetric("rover_imaging_heap_objects", "gauge", "Number of allocated Go heap objects")
+	gcCycles    = newMetric("rover_imaging_gc_cycles_total", "counter", "Completed garbage collection cycles")
+	openMats    = newMetric("rover_imaging_open_mats", "gauge", "Mats that are not closed, only counted when built with -tags matprofile")
+)
+
+// All metrics, in the order they are served
+var metrics []*metric
+
+// A counter or gauge, the value is stored as float64 bits so it can be changed without a lock
+type metric struct {
+	name string
+	kind string // "counter" or "gauge"
+	help string
+	bits atomic.Uint64
+}
+
+func newMetric(name string, kind string, help string) *metric {
+	m := &metric{name: name, kind: kind, help: help}
+	metrics = append(metrics, m)
+	return m
+}
+
+func (m *metric) inc() {
+	m.add(1)
+}
+
+func (m *metric) add(delta float64) {
+	for {
+		old := m.bits.Load()
+		if m.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (m *metric) set(value float64) {
+	m.bits.Store(math.Float64bits(value))
+}
+
+func (m *metric) value() float64 {
+	return math.Float64frombits(m.bits.Load())
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	updateRuntimeMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value())
+	}
+}
+
+func updateRuntimeMetrics() {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	heapBytes.set(float64(stats.HeapAlloc))
+	heapObjects.set(float64(stats.HeapObjects))
+	gcCycles.set(float64(stats.NumGC))
+	openMats.set(float64(gocv.MatProfile.Count()))
+}
+
+// Serves /metrics on the given address in the background, an empty address disables it
+func startMetricsServer(address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		log.Err(err).Str("address", address).Msg("Metrics server stopped")
+	}()
+	log.Info().Str("address", address).Msg("Serving metrics")
+}
+
+// Frames per second, smoothed over a few frames
+type fpsMeter struct {
+	fps  float64
+	last time.Time
+}
+
+// Counts a frame and returns the current rate
+func (f *fpsMeter) tick() float64 {
+	now := time.Now()
+	if !f.last.IsZero() {
+		if interval := now.Sub(f.last).Seconds(); interval > 0 {
+			f.fps = 0.9*f.fps + 0.1/interval
+		}
+	}
+	f.last = now
+	return f.fps
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// An MJPEG stream over http (multipart/x-mixed-replace), as served by the simulator, ffmpeg or most IP cameras.
+// It is read in plain Go and only the JPEG decoding is done by OpenCV, so it does not need a gstreamer or ffmpeg
+// build of OpenCV.
+type mjpegStream struct {
+	response *http.Response
+	parts    *multipart.Reader
+	jpeg     bytes.Buffer // reused for every frame
+}
+
+// A frame that takes longer than this closes the stream, the reads then fail until the camera is reopened
+const mjpegFrameTimeout = 2 * time.Second
+
+// Only connecting and the headers have a timeout, the body of the stream never ends
+var mjpegClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		ResponseHeaderTimeout: 5 * time.Second,
+	},
+}
+
+func openMjpegStream(address string) sourceOpener {
+	return func() (frameSource, error) {
+		response, err := mjpegClient.Get(address)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, fmt.Errorf("MJPEG stream %s: %s", address, response.Status)
+		}
+		contentType := response.Header.Get("Content-Type")
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+			response.Body.Close()
+			return nil, fmt.Errorf("%s is not an MJPEG stream, its Content-Type is %q", address, contentType)
+		}
+		// Some servers put the dashes of the delimiter in the boundary
+		boundary := strings.TrimPrefix(params["boundary"], "--")
+		return &mjpegStream{
+			response: response,
+			parts:    multipart.NewReader(response.Body, boundary),
+		}, nil
+	}
+}
+
+func (s *mjpegStream) Read(m *gocv.Mat) bool {
+	// A stalled stream would block the capture forever, closing the body ends the read
+	watchdog := time.AfterFunc(mjpegFrameTimeout, func() { s.response.Body.Close() })
+	defer watchdog.Stop()
+
+	part, err := s.parts.NextPart()
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read the next MJPEG frame")
+		return false
+	}
+	s.jpeg.Reset()
+	_, err = s.jpeg.ReadFrom(part)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read an MJPEG frame")
+		return false
+	}
+
+	decoded, err := gocv.IMDecode(s.jpeg.Bytes(), gocv.IMReadColor)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to decode an MJPEG frame")
+		return false
+	}
+	defer decoded.Close()
+	if decoded.Empty() {
+		return false
+	}
+	decoded.CopyTo(m)
+	return true
+}
+
+func (s *mjpegStream) Close() error {
+	return s.response.Body.Close()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// Returns a small JPEG
+func testJpeg(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// A multipart body with one part per frame and the given boundary. With closed false the stream ends without the
+// closing delimiter, like a connection that drops.
+func mjpegBody(t *testing.T, boundary string, frames [][]byte, closed bool) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if err := w.SetBoundary(boundary); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(frame)
+	}
+	if closed {
+		w.Close()
+	}
+	return b.Bytes()
+}
+
+// Serves body once per request with the given Content-Type
+func serveMjpeg(t *testing.T, contentType string, body []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Reads len(want) frames from the source and checks which of the reads succeed
+func expectReads(t *testing.T, source frameSource, want []bool) {
+	t.Helper()
+	frame := gocv.NewMat()
+	defer frame.Close()
+	for i, ok := range want {
+		if got := source.Read(&frame); got != ok {
+			t.Errorf("read %d: got %v, want %v", i, got, ok)
+		}
+	}
+}
+
+func TestMjpegStream(t *testing.T) {
+	frame := testJpeg(t)
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		reads       []bool
+	}{
+		{
+			name:        "good frames",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			body:        mjpegBody(t, "frame", [][]byte{frame, frame}, true),
+			reads:       []bool{true, true, false},
+		},
+		{
+			name:        "boundary with dashes",
+			contentType: "multipart/x-mixed-replace; boundary=--frame",
+			body:        mjpegBody(t, "frame", [][]byte{frame}, true),
+			reads:       []bool{true, false},
+		},
+		{
+			// A part that is cut off does not decode, the stream goes on with the next part
+			name:        "truncated part",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			body:        mjpegBody(t, "frame", [][]byte{frame, frame[:10], frame}, true),
+			reads:       []bool{true, false, true, false},
+		},
+		{
+			// The parts are delimited by another boundary than the header announces
+			name:        "bad boundary",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			body:        mjpegBody(t, "other", [][]byte{frame, frame}, true),
+			reads:       []bool{false, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := serveMjpeg(t, test.contentType, test.body)
+			source, err := openMjpegStream(server.URL)()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+			expectReads(t, source, test.reads)
+		})
+	}
+}
+
+func TestMjpegStreamEndsInPart(t *testing.T) {
+	frame := testJpeg(t)
+	// The second part is cut off by the end of the stream
+	body := mjpegBody(t, "frame", [][]byte{frame, frame}, false)
+	body = body[:len(body)-len(frame)/2]
+	server := serveMjpeg(t, "multipart/x-mixed-replace; boundary=frame", body)
+	source, err := openMjpegStream(server.URL)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	expectReads(t, source, []bool{true, false})
+}
+
+func TestOpenMjpegStreamRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+	}{
+		{"not multipart", "image/jpeg", http.StatusOK},
+		{"no boundary", "multipart/x-mixed-replace", http.StatusOK},
+		{"error status", "multipart/x-mixed-replace; boundary=frame", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+			if source, err := openMjpegStream(server.URL)(); err == nil {
+				source.Close()
+				t.Error("opened the stream")
+			}
+		})
+	}
+}
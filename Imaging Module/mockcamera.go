@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// A camera without hardware, selected with the test-pattern frame source (see source.go). It renders a white lane
+// on a black floor that slowly sways left and right, and can fail on purpose to test the camera health handling:
+//
+//	ok     always delivers frames
+//	flaky  fails 40 reads in a row after every 300 frames, enough to be reported unhealthy and reopened
+//	dead   never delivers a frame
+type mockCamera struct {
+	mode     string
+	frame    gocv.Mat
+	width    int
+	height   int
+	interval time.Duration // time between frames
+	last     time.Time
+	count    int // frames delivered
+	failing  int // reads that still fail
+}
+
+const (
+	mockFlakyFrames   = 300
+	mockFlakyFailures = 40
+)
+
+// The mode and size are checked by frameSourceConfig
+func openMockCamera(mode string, width int, height int, fps int) sourceOpener {
+	return func() (frameSource, error) {
+		return &mockCamera{
+			mode:     mode,
+			frame:    gocv.NewMatWithSize(height, width, gocv.MatTypeCV8UC3),
+			width:    width,
+			height:   height,
+			interval: time.Second / time.Duration(fps),
+		}, nil
+	}
+}
+
+func (c *mockCamera) Read(m *gocv.Mat) bool {
+	// Pace the frames like a real camera
+	if wait := c.interval - time.Since(c.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	c.last = time.Now()
+
+	switch {
+	case c.mode == "dead":
+		return false
+	case c.failing > 0:
+		c.failing--
+		return false
+	case c.mode == "flaky" && c.count > 0 && c.count%mockFlakyFrames == 0:
+		c.failing = mockFlakyFailures - 1
+		c.count++
+		return false
+	}
+	c.count++
+
+	// A lane of a quarter of the image width in the bottom half, its center sways around the middle
+	sway := math.Sin(float64(c.count)/60) * float64(c.width) / 8
+	center := c.width/2 + int(sway)
+	c.frame.SetTo(gocv.NewScalar(0, 0, 0, 0))
+	lane := image.Rect(center-c.width/8, c.height/2, center+c.width/8, c.height)
+	gocv.Rectangle(&c.frame, lane, color.RGBA{R: 255, G: 255, B: 255, A: 0}, -1)
+	c.frame.CopyTo(m)
+	return true
+}
+
+func (c *mockCamera) Close() error {
+	return c.frame.Close()
+}
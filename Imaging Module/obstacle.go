@@ -0,0 +1,80 @@
+package main
+
+// Set in the Flags of the CameraSensorOutput when there is an obstacle on the lane ahead, its distance is in the
+// frame extension (see extension.go). Keep this in sync with the controller.
+const flagObstacle = uint32(1 << 1)
+
+const (
+	// An obstacle must cover at least this many rows of a 480 rows high frame (see scaleRow), smaller holes are noise
+	obstacleMinRows = 6
+	// Frames in a row an obstacle must be seen in before it is reported
+	obstacleConfirmFrames = 2
+)
+
+// Looks for obstacles in the lane ahead. Anything that is not lane shows up black in the mask, so an obstacle is a
+// black hole in the white lane: the vertical scan up the center of the lane hits black, while the lane continues on
+// both sides of it. When the lane itself ends (a curve or the end of the track) it does not continue on both sides.
+// Only frames in which a lane was found are checked.
+type obstacleDetector struct {
+	enabled bool
+	column  []byte // buffer for the center column of the lane
+	seen    int    // consecutive frames with an obstacle
+}
+
+// Checks the lane of a frame. Returns the distance of the obstacle as the fraction of the image height between the
+// bottom row and the bottom of the obstacle (0 is right in front of the rover, 1 at the top of the image).
+func (d *obstacleDetector) detect(pixels grayImage, lane SliceDescriptor, widths *laneWidthModel) (float32, bool) {
+	if !d.enabled {
+		return 0, false
+	}
+	row, found := d.find(pixels, lane, widths)
+	if !found {
+		d.seen = 0
+		return 0, false
+	}
+	d.seen++
+	if d.seen < obstacleConfirmFrames {
+		return 0, false
+	}
+	return float32(pixels.height-1-row) / float32(max(pixels.height-1, 1)), true
+}
+
+// Returns the bottom row of the obstacle in the lane, if there is one
+func (d *obstacleDetector) find(pixels grayImage, lane SliceDescriptor, widths *laneWidthModel) (int, bool) {
+	x := min(max((lane.Start+lane.End)/2, 0), pixels.width-1)
+	d.column = pixels.column(x, d.column)
+
+	// The drivable area ends at the first black pixel from the bottom up. When the bottom row is black already the
+	// obstacle is right in front of the rover, unless the rover is not on the lane: the checks below tell them apart.
+	y := verticalScanUp(d.column, pixels.height-1)
+	if d.column[y] != 0 {
+		// White up to the top
+		return 0, false
+	}
+
+	// The hole must be tall enough
+	top := y
+	for top > 0 && d.column[top-1] == 0 {
+		top--
+	}
+	if y-top+1 < max(scaleRow(obstacleMinRows, pixels.height), 1) {
+		return 0, false
+	}
+
+	// And the lane must continue on both sides of it, with the hole narrower than the lane
+	row := pixels.row(y)
+	left, right := x, x
+	for left > 0 && row[left-1] == 0 {
+		left--
+	}
+	for right < pixels.width-1 && row[right+1] == 0 {
+		right++
+	}
+	if left == 0 || right == pixels.width-1 {
+		return 0, false
+	}
+	if float64(right-left+1) >= widths.expected(y, pixels.width, pixels.height) {
+		return 0, false
+	}
+	return y, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+// A 100x100 mask with a 40 pixels wide lane in the middle and a black hole over the given rows and columns
+func maskWithHole(top int, bottom int, left int, right int) grayImage {
+	pixels := grayImage{data: make([]byte, 100*100), step: 100, width: 100, height: 100}
+	for y := 0; y < 100; y++ {
+		for x := 30; x < 70; x++ {
+			if y < top || y > bottom || x < left || x > right {
+				pixels.data[y*100+x] = 255
+			}
+		}
+	}
+	return pixels
+}
+
+func TestObstacleDetector(t *testing.T) {
+	widths := laneWidthModel{top: 0.4, bottom: 0.4, tolerance: 0.5}
+	lane := SliceDescriptor{Start: 30, End: 69}
+	tests := []struct {
+		name     string
+		pixels   grayImage
+		found    bool
+		distance float32
+	}{
+		{"no obstacle", maskWithHole(-1, -1, -1, -1), false, 0},
+		{"obstacle ahead", maskWithHole(40, 65, 45, 55), true, float32(99-65) / 99},
+		{"obstacle in the bottom row", maskWithHole(80, 99, 45, 55), true, 0},
+		{"lane ends", maskWithHole(0, 40, 0, 99), false, 0},
+		{"rover not on the lane", maskWithHole(0, 99, 40, 99), false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := obstacleDetector{enabled: true}
+			// The first sighting is not reported yet
+			for i := 0; i < obstacleConfirmFrames; i++ {
+				distance, found := detector.detect(test.pixels, lane, &widths)
+				if i < obstacleConfirmFrames-1 && found {
+					t.Fatalf("reported on frame %d", i)
+				}
+				if i == obstacleConfirmFrames-1 && (found != test.found || distance != test.distance) {
+					t.Errorf("got %v at %f, want %v at %f", found, distance, test.found, test.distance)
+				}
+			}
+		})
+	}
+}
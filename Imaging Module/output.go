@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	pb_output "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	"google.golang.org/protobuf/proto"
+)
+
+// The message sent on the path output for every frame. It is allocated once and refilled for every frame, so the
+// loop does not build a new message tree and marshal buffer per frame. It only carries the trajectory, the debug
+// frame is sent on its own output (see debugOutput), so the controller does not receive the JPEG bytes.
+type frameOutput struct {
+	message  *pb_output.SensorOutput
+	camera   *pb_output.CameraSensorOutput
+	points   []*pb_output.CameraSensorOutput_Trajectory_Point // one per trajectory row, see traceLane
+	buffer   []byte
+	session  uint64 // identifies this run of the imaging module, so the controller notices a restart
+	sequence uint64 // sequence number of the last message
+}
+
+func newFrameOutput() *frameOutput {
+	f := &frameOutput{
+		session: rand.Uint64(),
+	}
+	for i := 0; i < trajectoryRows; i++ {
+		f.points = append(f.points, &pb_output.CameraSensorOutput_Trajectory_Point{})
+	}
+	f.camera = &pb_output.CameraSensorOutput{
+		Trajectory: &pb_output.CameraSensorOutput_Trajectory{},
+		Flags:      0,
+	}
+	f.message = &pb_output.SensorOutput{
+		SensorId: 25,
+		SensorOutput: &pb_output.SensorOutput_CameraOutput{
+			CameraOutput: f.camera,
+		},
+	}
+	return f
+}
+
+// Fills in the trajectory of a width x height frame (the lookahead row first) and the flags, and marshals the message.
+// The returned bytes are only valid until the next call.
+func (f *frameOutput) marshal(trajectory []trajectoryPoint, width int, height int, flags uint32, captured time.Time) ([]byte, error) {
+	n := min(len(trajectory), len(f.points))
+	for i, point := range trajectory[:n] {
+		// A lane inferred from one edge can have its center outside the image
+		f.points[i].X, f.points[i].Y = uint32(min(max(point.x, 0), width-1)), uint32(point.y)
+	}
+	f.camera.Trajectory.Points = f.points[:n]
+	f.camera.Trajectory.Width, f.camera.Trajectory.Height = uint32(width), uint32(height)
+	f.camera.Flags = flags
+	f.message.Timestamp = uint64(captured.UnixMilli())
+
+	var err error
+	f.buffer, err = proto.MarshalOptions{}.MarshalAppend(f.buffer[:0], f.message)
+	return f.buffer, err
+}
+
+// Marshals a message without trajectory points that tells the controller the camera does not deliver frames.
+// The returned bytes are only valid until the next call.
+func (f *frameOutput) marshalCameraUnhealthy(now time.Time) ([]byte, error) {
+	f.camera.Trajectory.Points = nil
+	f.camera.Flags = flagCameraUnhealthy
+	f.message.Timestamp = uint64(now.UnixMilli())
+
+	var err error
+	f.buffer, err = proto.MarshalOptions{}.MarshalAppend(f.buffer[:0], f.message)
+	f.camera.Flags = 0
+	return f.buffer, err
+}
+
+// Appends the extension (see extension.go) to the message that was marshalled last, with the next sequence number
+func (f *frameOutput) extend(ext frameExtension) []byte {
+	f.sequence++
+	ext.sequence = f.sequence
+	ext.session = f.session
+	f.buffer = appendFrameExtension(f.buffer, ext)
+	return f.buffer
+}
+
+// The message sent on the debug output, with the JPEG of the debug frame and a canvas that marks the lane.
+// Like frameOutput it is allocated once and refilled for every debug frame.
+type debugOutput struct {
+	message    *pb_output.SensorOutput
+	debugFrame *pb_output.CameraSensorOutput_DebugFrame
+	canvas     *pb_output.Canvas
+	start      *pb_output.CanvasObject_Point // where the lane starts in the slice
+	end        *pb_output.CanvasObject_Point // where the lane ends in the slice
+	middle     *pb_output.CanvasObject_Point // the middle of the lane
+	buffer     []byte
+}
+
+func newDebugOutput() *debugOutput {
+	d := &debugOutput{
+		start:  &pb_output.CanvasObject_Point{},
+		end:    &pb_output.CanvasObject_Point{},
+		middle: &pb_output.CanvasObject_Point{},
+	}
+	circle := func(center *pb_output.CanvasObject_Point) *pb_output.CanvasObject {
+		return &pb_output.CanvasObject{
+			Object: &pb_output.CanvasObject_Circle_{
+				Circle: &pb_output.CanvasObject_Circle{
+					Center: center,
+					Radius: 1,
+				},
+			},
+		}
+	}
+	d.canvas = &pb_output.Canvas{
+		Objects: []*pb_output.CanvasObject{circle(d.start), circle(d.end), circle(d.middle)},
+	}
+	d.debugFrame = &pb_output.CameraSensorOutput_DebugFrame{
+		Canvas: d.canvas,
+	}
+	d.message = &pb_output.SensorOutput{
+		SensorId: 25,
+		SensorOutput: &pb_output.SensorOutput_CameraOutput{
+			CameraOutput: &pb_output.CameraSensorOutput{
+				DebugFrame: d.debugFrame,
+			},
+		},
+	}
+	return d
+}
+
+// Fills in the encoded frame and the lane drawn on it and marshals the message.
+// The returned bytes are only valid until the next call.
+func (d *debugOutput) marshal(frame *debugFrame) ([]byte, error) {
+	sliceY := uint32(frame.row)
+	// A lane inferred from one edge extends beyond the image
+	clampX := func(x int) uint32 { return uint32(min(max(x, 0), frame.width-1)) }
+	d.start.X, d.start.Y = clampX(frame.lane.Start), sliceY
+	d.end.X, d.end.Y = clampX(frame.lane.End), sliceY
+	d.middle.X, d.middle.Y = clampX((frame.lane.Start+frame.lane.End)/2), sliceY
+	d.canvas.Width = uint32(frame.width)
+	d.canvas.Height = uint32(frame.height)
+	d.debugFrame.Jpeg = frame.jpeg
+	d.message.Timestamp = uint64(frame.captured.UnixMilli())
+
+	var err error
+	d.buffer, err = proto.MarshalOptions{}.MarshalAppend(d.buffer[:0], d.message)
+	d.debugFrame.Jpeg = nil
+	return d.buffer, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import "gocv.io/x/gocv"
+
+// The imaging loop is split into stages that run concurrently, so a slow stage never delays the trajectory:
+//
+//	capture   reads frames from the camera, only the latest frame is kept (see startCapture)
+//	detection the run loop, segments the frame and publishes the trajectory right away
+//	debug     draws and encodes the debug frame with low priority (see debug.go)
+//
+// The stages hand over through channels with a single slot. When a stage falls behind, the item that is
+// waiting is dropped for the newer one (drop-oldest), so latency never builds up. All stages stop when the
+// service is terminated (see shutdown.go).
+
+// Frames in flight: one being read, one waiting for the detection and one being detected
+const capturedFrames = 3
+
+type capturedFrame struct {
+	mat   gocv.Mat
+	timer frameTimer
+}
+
+// Reads frames from the camera in the background, until the service stops. The detection takes frames from latest
+// and must hand them back through free as soon as it no longer needs the Mat. The capture owns the source: it is
+// reopened with open after repeated failures (see camera.go) and closed before done is closed.
+func startCapture(source frameSource, open sourceOpener, health *cameraHealth) (latest chan *capturedFrame, free chan *capturedFrame, done chan struct{}) {
+	latest = make(chan *capturedFrame, 1)
+	free = make(chan *capturedFrame, capturedFrames)
+	done = make(chan struct{})
+	for i := 0; i < capturedFrames; i++ {
+		free <- &capturedFrame{mat: gocv.NewMat()}
+	}
+
+	go func() {
+		defer close(done)
+		defer func() {
+			if source != nil {
+				source.Close()
+			}
+		}()
+		for {
+			var frame *capturedFrame
+			select {
+			case <-stopping:
+				return
+			case frame = <-free:
+			}
+			frame.timer.start()
+			// The source is nil when reopening it failed, that counts as a failed read as well
+			if source == nil || !source.Read(&frame.mat) || frame.mat.Empty() {
+				framesDropped.inc()
+				free <- frame
+				backoff, reopen := health.failed()
+				if reopen || source == nil {
+					source = reopenSource(source, open)
+				}
+				if !waitOrStop(backoff) {
+					return
+				}
+				continue
+			}
+			health.succeeded()
+			frame.timer.captured()
+
+			if offerLatest(latest, frame, free) {
+				// The detection did not keep up, it will get this newer frame instead
+				framesDropped.inc()
+			}
+		}
+	}()
+	return latest, free, done
+}
+
+// Closes the Mats of the captured frames, call this when the capture and the detection stopped
+func releaseFrames(latest chan *capturedFrame, free chan *capturedFrame) {
+	select {
+	case frame := <-latest:
+		free <- frame
+	default:
+	}
+	for i := 0; i < capturedFrames; i++ {
+		frame := <-free
+		frame.mat.Close()
+	}
+}
+
+// Puts item in the single slot channel latest. An item that is still waiting there is dropped and handed back
+// through free. Only one goroutine may offer to latest. Returns true if an item was dropped.
+func offerLatest[T any](latest chan T, item T, free chan T) bool {
+	select {
+	case latest <- item:
+		return false
+	default:
+	}
+
+	dropped := false
+	select {
+	case old := <-latest:
+		free <- old
+		dropped = true
+	default:
+		// Taken in the meantime
+	}
+	latest <- item
+	return dropped
+}
@@ -0,0 +1,119 @@
+//go:build dynamic || static
+
+package main
+
+import (
+	"testing"
+
+	pb_output "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	"gocv.io/x/gocv"
+	"google.golang.org/protobuf/proto"
+)
+
+// The lane width model of the test frames: the lane is a quarter of the image wide at the top and half at the bottom
+var testLaneWidths = laneWidthModel{top: 0.25, bottom: 0.5, tolerance: 0.5}
+
+// Returns the pixels of a width x height BGR frame with a white lane on a black floor, centered and as wide as
+// testLaneWidths expects in every row
+func laneFrameBytes(width int, height int) []byte {
+	data := make([]byte, width*height*3)
+	for y := 0; y < height; y++ {
+		laneWidth := int(testLaneWidths.expected(y, width, height))
+		start := (width - laneWidth) / 2
+		for x := start; x < start+laneWidth; x++ {
+			i := (y*width + x) * 3
+			data[i], data[i+1], data[i+2] = 255, 255, 255
+		}
+	}
+	return data
+}
+
+// A detector of the variant the test is built with, with the test frame captured
+func newTestDetector(t testing.TB) (*laneDetector, *capturedFrame) {
+	frame, err := gocv.NewMatFromBytes(480, 640, gocv.MatTypeCV8UC3, laneFrameBytes(640, 480))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { frame.Close() })
+	widths := testLaneWidths
+	detector := newLaneDetector(newLaneFinder(640), &widths, true)
+	t.Cleanup(detector.close)
+	return detector, &capturedFrame{mat: frame}
+}
+
+// Runs the detection of the frame, as the run loop does with every frame it takes from the capture
+func detectTestFrame(t testing.TB, detector *laneDetector, frame *capturedFrame, free chan *capturedFrame) {
+	frame.timer.start()
+	frame.timer.captured()
+	result, err := detector.detect(frame, free, 128)
+	<-free
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.found {
+		t.Fatal("no lane found in the test frame")
+	}
+}
+
+// All buffers are reused, so after the first frame the detection must not allocate
+func TestPipelineDoesNotAllocate(t *testing.T) {
+	detector, frame := newTestDetector(t)
+	free := make(chan *capturedFrame, 1)
+	// The first frame sizes the Mats and buffers
+	detectTestFrame(t, detector, frame, free)
+	allocs := testing.AllocsPerRun(100, func() {
+		detectTestFrame(t, detector, frame, free)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per frame, want 0", allocs)
+	}
+}
+
+// A frame without a lane is published as well, without trajectory points, so the controller stops
+func TestPipelinePublishesLostLane(t *testing.T) {
+	detector, _ := newTestDetector(t)
+	black, err := gocv.NewMatFromBytes(480, 640, gocv.MatTypeCV8UC3, make([]byte, 640*480*3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer black.Close()
+	frame := &capturedFrame{mat: black}
+	frame.timer.start()
+	frame.timer.captured()
+	free := make(chan *capturedFrame, 1)
+	result, err := detector.detect(frame, free, 128)
+	<-free
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.found {
+		t.Fatal("lane found in a black frame")
+	}
+	message := &pb_output.SensorOutput{}
+	if err := proto.Unmarshal(result.message, message); err != nil {
+		t.Fatal(err)
+	}
+	if points := message.GetCameraOutput().GetTrajectory().GetPoints(); len(points) != 0 {
+		t.Errorf("%d trajectory points, want none", len(points))
+	}
+	if len(message.ProtoReflect().GetUnknown()) == 0 {
+		t.Error("the frame extension is missing")
+	}
+	if detector.output.sequence != 1 {
+		t.Errorf("sequence %d, want 1", detector.output.sequence)
+	}
+}
+
+// Runs the detection of the variant the test is built with (gray, threshold, morphology, scan, measure, trace and
+// marshal) on the same 640x480 frame, allocs/op must be 0 (see TestPipelineDoesNotAllocate)
+func BenchmarkPipeline(b *testing.B) {
+	detector, frame := newTestDetector(b)
+	free := make(chan *capturedFrame, 1)
+	// The first frame sizes the Mats and buffers
+	detectTestFrame(b, detector, frame, free)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		detectTestFrame(b, detector, frame, free)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+
+	"gocv.io/x/gocv"
+)
+
+// The scans below run in plain Go on the bytes of the (thresholded) image. Reading pixel by pixel
+// through GetVecbAt/GetUCharAt costs a cgo call per pixel, here the image is pulled from the Mat once per frame.
+
+// The row constants of the lookahead were tuned on 640x480 frames, scaleRow converts such a row (or distance in rows)
+// to a frame of the given height
+const tunedHeight = 480
+
+func scaleRow(row int, height int) int {
+	return row * height / tunedHeight
+}
+
+type SliceDescriptor struct {
+	Start int // Start index of the array
+	End   int // End index of the array
+}
+
+// A single channel 8-bit image, the data is shared with the Mat and only valid until the Mat changes
+type grayImage struct {
+	data   []byte
+	step   int // bytes per row, can be more than the width
+	width  int
+	height int
+}
+
+func newGrayImage(m *gocv.Mat) (grayImage, error) {
+	if m.Channels() != 1 {
+		return grayImage{}, fmt.Errorf("expected a single channel image, got %d channels", m.Channels())
+	}
+	data, err := m.DataPtrUint8()
+	if err != nil {
+		return grayImage{}, err
+	}
+	return grayImage{
+		data:   data,
+		step:   m.Step(),
+		width:  m.Cols(),
+		height: m.Rows(),
+	}, nil
+}
+
+// Returns row y, without copying
+func (g grayImage) row(y int) []byte {
+	return g.data[y*g.step : y*g.step+g.width]
+}
+
+// Copies column x into buf (which is grown if needed) and returns it, index 0 is the top of the image
+func (g grayImage) column(x int, buf []byte) []byte {
+	buf = buf[:0]
+	for y := 0; y < g.height; y++ {
+		buf = append(buf, g.data[y*g.step+x])
+	}
+	return buf
+}
+
+// This function scans the row for points that are full white (non-black) (after thresholding)
+// It appends descriptions of the consecutive white points to res and returns it, so res can be reused between frames
+// r.i.p. mrbuggy :(
+func getConsecutiveWhitePointsFromSlice(row []byte, res []SliceDescriptor) []SliceDescriptor {
+	start := -1 // start of the current consecutive array, -1 if there is none
+
+	for i, b := range row {
+		// byte(0) indicates black, byte(255) indicates white
+		if b != 0 {
+			// Current point is a white point, start a new consecutive array if there is none yet
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			// Current point is black, add the consecutive array, if it's at minimum 1 pixel wide
+			if i-1 > start {
+				res = append(res, SliceDescriptor{Start: start, End: i - 1})
+			}
+			start = -1
+		}
+	}
+
+	// We reached the right edge of the image. If there is a consecutive array, add it to the result
+	if start >= 0 && len(row)-1 > start {
+		res = append(res, SliceDescriptor{Start: start, End: len(row) - 1})
+	}
+
+	return res
+}
+
+// This function scans the column upwards (= towards a smaller y), starting at startY
+// it returns the y of the first black pixel it encounters, or 0 if there is none
+func verticalScanUp(column []byte, startY int) int {
+	for y := min(startY, len(column)-1); y >= 0; y-- {
+		if column[y] == 0 {
+			return y
+		}
+	}
+	return 0
+}
+
+// Finds the boundary (the transition from black above to white below) again, starting at the boundary of the previous frame.
+// It moves two pixels at a time, down if prevY is black and up if it is white
+func detectNewBoundary(column []byte, prevY int) int {
+	y := min(max(prevY, 0), len(column)-1)
+
+	if column[y] == 0 { // look for white
+		for y+2 <= len(column)-1 { // go down until you find white
+			y = y + 2 // O(n/2)
+			if column[y] == 255 {
+				break
+			}
+		}
+	} else { // look for black
+		for y-2 >= 0 { // go up until you find black
+			y = y - 2
+			if column[y] == 0 {
+				break
+			}
+		}
+	}
+	return y
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// Builds a row (or column) from runs of white pixels, every other byte is black
+func pixelsWithRuns(length int, runs ...SliceDescriptor) []byte {
+	pixels := make([]byte, length)
+	for _, run := range runs {
+		for i := run.Start; i <= run.End; i++ {
+			pixels[i] = 255
+		}
+	}
+	return pixels
+}
+
+func TestGetConsecutiveWhitePointsFromSlice(t *testing.T) {
+	tests := []struct {
+		name string
+		row  []byte
+		want []SliceDescriptor
+	}{
+		{"empty row", []byte{}, []SliceDescriptor{}},
+		{"all black", pixelsWithRuns(16), []SliceDescriptor{}},
+		{"all white", pixelsWithRuns(16, SliceDescriptor{0, 15}), []SliceDescriptor{{0, 15}}},
+		{"single run", pixelsWithRuns(16, SliceDescriptor{4, 9}), []SliceDescriptor{{4, 9}}},
+		{"run starting on the first column", pixelsWithRuns(16, SliceDescriptor{0, 3}), []SliceDescriptor{{0, 3}}},
+		{"run ending on the last column", pixelsWithRuns(16, SliceDescriptor{10, 15}), []SliceDescriptor{{10, 15}}},
+		{"several runs", pixelsWithRuns(16, SliceDescriptor{0, 2}, SliceDescriptor{5, 8}, SliceDescriptor{12, 15}), []SliceDescriptor{{0, 2}, {5, 8}, {12, 15}}},
+		{"single pixels are dropped", pixelsWithRuns(16, SliceDescriptor{3, 3}, SliceDescriptor{7, 8}, SliceDescriptor{15, 15}), []SliceDescriptor{{7, 8}}},
+		{"any non-black value is white", []byte{0, 1, 128, 0}, []SliceDescriptor{{1, 2}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := getConsecutiveWhitePointsFromSlice(test.row, []SliceDescriptor{})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetConsecutiveWhitePointsFromSliceAppends(t *testing.T) {
+	res := []SliceDescriptor{{1, 2}}
+	got := getConsecutiveWhitePointsFromSlice(pixelsWithRuns(8, SliceDescriptor{4, 6}), res)
+	want := []SliceDescriptor{{1, 2}, {4, 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestVerticalScanUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		column []byte
+		startY int
+		want   int
+	}{
+		{"black at the start", pixelsWithRuns(10, SliceDescriptor{0, 4}), 9, 9},
+		{"black above the start", pixelsWithRuns(10, SliceDescriptor{5, 9}), 9, 4},
+		{"white up to the top", pixelsWithRuns(10, SliceDescriptor{0, 9}), 9, 0},
+		{"start below the image", pixelsWithRuns(10, SliceDescriptor{3, 9}), 20, 2},
+		{"start in the middle", pixelsWithRuns(10, SliceDescriptor{2, 9}), 5, 1},
+		{"single pixel", []byte{0}, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verticalScanUp(test.column, test.startY); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectNewBoundary(t *testing.T) {
+	// Black above row 6, white from row 6 down
+	column := pixelsWithRuns(12, SliceDescriptor{6, 11})
+	tests := []struct {
+		name   string
+		column []byte
+		prevY  int
+		want   int
+	}{
+		{"moves down from black to white", column, 2, 6},
+		{"moves up from white to black", column, 10, 4},
+		{"steps two rows at a time", column, 3, 7},
+		{"stops at the bottom", pixelsWithRuns(12), 6, 10},
+		{"stops at the top", pixelsWithRuns(12, SliceDescriptor{0, 11}), 5, 1},
+		{"previous row below the image", column, 30, 5},
+		{"previous row above the image", column, -4, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := detectNewBoundary(test.column, test.prevY); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// The scans as they were before scan.go, reading every pixel through GetVecbAt, for the benchmarks below
+
+func getConsecutiveWhitePointsFromMat(imageSlice *gocv.Mat) []SliceDescriptor {
+	res := []SliceDescriptor{}
+	var currentConsecutive *SliceDescriptor = nil
+	for i := 0; i < imageSlice.Cols()-1; i++ {
+		if imageSlice.GetVecbAt(0, i)[0] != byte(0) {
+			if currentConsecutive == nil {
+				currentConsecutive = &SliceDescriptor{Start: i, End: i}
+			} else {
+				currentConsecutive.End = i
+			}
+		} else if currentConsecutive != nil {
+			if currentConsecutive.End-currentConsecutive.Start > 0 {
+				res = append(res, *currentConsecutive)
+			}
+			currentConsecutive = nil
+		}
+	}
+	if currentConsecutive != nil && currentConsecutive.End-currentConsecutive.Start > 0 {
+		res = append(res, *currentConsecutive)
+	}
+	return res
+}
+
+func verticalScanUpMat(imageSlice *gocv.Mat) int {
+	y := imageSlice.Rows() - 1
+	for y >= 0 {
+		if imageSlice.GetVecbAt(y, 0)[0] == 0 {
+			return y
+		}
+		y--
+	}
+	return y + 1
+}
+
+// A 640 pixels wide row with a lane and some noise
+func benchmarkRow() []byte {
+	return pixelsWithRuns(640, SliceDescriptor{20, 23}, SliceDescriptor{200, 440}, SliceDescriptor{600, 639})
+}
+
+func BenchmarkGetConsecutiveWhitePointsFromSlice(b *testing.B) {
+	row := benchmarkRow()
+	res := []SliceDescriptor{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res = getConsecutiveWhitePointsFromSlice(row, res[:0])
+	}
+}
+
+func BenchmarkGetConsecutiveWhitePointsFromMat(b *testing.B) {
+	row := benchmarkRow()
+	mat, err := gocv.NewMatFromBytes(1, len(row), gocv.MatTypeCV8UC1, row)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mat.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getConsecutiveWhitePointsFromMat(&mat)
+	}
+}
+
+// A 480 rows high column, white in the bottom half
+func benchmarkColumn() []byte {
+	return pixelsWithRuns(480, SliceDescriptor{240, 479})
+}
+
+func BenchmarkVerticalScanUp(b *testing.B) {
+	column := benchmarkColumn()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		verticalScanUp(column, len(column)-1)
+	}
+}
+
+func BenchmarkVerticalScanUpMat(b *testing.B) {
+	column := benchmarkColumn()
+	mat, err := gocv.NewMatFromBytes(len(column), 1, gocv.MatTypeCV8UC1, column)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mat.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		verticalScanUpMat(&mat)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long the termination waits for the stages to stop and release the camera and sockets
+const shutdownTimeout = 2 * time.Second
+
+var (
+	// Closed when the service is terminated, all stages (see pipeline.go) stop when it is closed
+	stopping = make(chan struct{})
+	stopOnce sync.Once
+	// Closed when run returned and released the camera and sockets
+	stopped = make(chan struct{})
+)
+
+// Signals all stages to stop, safe to call more than once
+func stop() {
+	stopOnce.Do(func() { close(stopping) })
+}
+
+// Called by the service runner on SIGINT/SIGTERM. The wait is bounded, the service runner exits after this returns.
+func onTerminate(sig os.Signal) {
+	log.Info().Str("signal", sig.String()).Msg("Terminating, stopping the imaging stages")
+	stop()
+	select {
+	case <-stopped:
+		log.Info().Msg("Imaging stopped")
+	case <-time.After(shutdownTimeout):
+		log.Warn().Dur("timeout", shutdownTimeout).Msg("Imaging did not stop in time")
+	}
+}
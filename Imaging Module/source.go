@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
+	servicerunner "github.com/VU-ASE/pkg-ServiceRunner/v2/src"
+	"github.com/rs/zerolog/log"
+)
+
+// The frame source is selected with the frame-source option:
+//
+//	device        a V4L2 camera that sends MJPEG (the device option), read through gstreamer
+//	gstreamer     the gstreamer-pipeline option as is, %d placeholders are filled with the width, height and fps
+//	url           an MJPEG stream over http(s) (read in plain Go, see mjpeg.go) or an rtsp stream (read by OpenCV)
+//	test-pattern  the mock camera (see mockcamera.go), the test-pattern option selects its mode
+//
+// All parameters are checked up front, so a typo shows up as a clear error instead of an OpenCV failure.
+type frameSourceConfig struct {
+	kind        string
+	device      string
+	pipeline    string
+	url         string
+	testPattern string
+	width       int
+	height      int
+	fps         int
+}
+
+// Pipeline for a V4L2 camera that sends MJPEG, decoded to grayscale
+const devicePipeline = "v4l2src device=%s ! image/jpeg, width=%d, height=%d, framerate=%d/1 ! jpegdec ! videoconvert n-threads=4 ! appsink caps=video/x-raw,format=GRAY8 name=appsink"
+
+// Reads the frame source options, the image size and fps are the imgWidth, imgHeight and imgFPS options
+func frameSourceFromTuning(tuning *pb_systemmanager_messages.TuningState, width int, height int, fps int) (sourceOpener, error) {
+	config := frameSourceConfig{width: width, height: height, fps: fps}
+	options := []struct {
+		name  string
+		value *string
+	}{
+		{"frame-source", &config.kind},
+		{"device", &config.device},
+		{"gstreamer-pipeline", &config.pipeline},
+		{"source-url", &config.url},
+		{"test-pattern", &config.testPattern},
+	}
+	for _, option := range options {
+		value, err := servicerunner.GetTuningString(option.name, tuning)
+		if err != nil {
+			log.Err(err).Str("option", option.name).Msg("Failed to get the frame source from tuning. Is it defined in service.yaml?")
+			return nil, err
+		}
+		*option.value = value
+	}
+	return config.opener()
+}
+
+// Checks the parameters of the selected source and returns a function that opens it
+func (c frameSourceConfig) opener() (sourceOpener, error) {
+	if c.width <= 0 || c.height <= 0 || c.fps <= 0 {
+		return nil, fmt.Errorf("invalid image size %dx%d at %d fps", c.width, c.height, c.fps)
+	}
+
+	switch c.kind {
+	case "device":
+		info, err := os.Stat(c.device)
+		if err != nil {
+			return nil, fmt.Errorf("camera device: %w", err)
+		}
+		if info.Mode()&os.ModeCharDevice == 0 {
+			return nil, fmt.Errorf("camera device %s is not a character device", c.device)
+		}
+		log.Info().Str("device", c.device).Msg("Reading frames from a camera device")
+		return openVideoCapture(fmt.Sprintf(devicePipeline, c.device, c.width, c.height, c.fps)), nil
+
+	case "gstreamer":
+		pipeline, err := fillPipeline(c.pipeline, c.width, c.height, c.fps)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("pipeline", pipeline).Msg("Reading frames from a gstreamer pipeline")
+		return openVideoCapture(pipeline), nil
+
+	case "url":
+		u, err := url.Parse(c.url)
+		if err != nil {
+			return nil, fmt.Errorf("source-url: %w", err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("source-url %q has no host", c.url)
+		}
+		log.Info().Str("url", u.Redacted()).Msg("Reading frames from a stream")
+		switch u.Scheme {
+		case "http", "https":
+			return openMjpegStream(u.String()), nil
+		case "rtsp", "rtsps":
+			return openVideoCapture(u.String()), nil
+		default:
+			return nil, fmt.Errorf("source-url %q must be an http(s) MJPEG stream or an rtsp stream", c.url)
+		}
+
+	case "test-pattern":
+		switch c.testPattern {
+		case "ok", "flaky", "dead":
+		default:
+			return nil, fmt.Errorf("unknown test-pattern %q, use ok, flaky or dead", c.testPattern)
+		}
+		log.Warn().Str("mode", c.testPattern).Msg("Using the test pattern instead of a camera")
+		return openMockCamera(c.testPattern, c.width, c.height, c.fps), nil
+
+	default:
+		return nil, fmt.Errorf("unknown frame-source %q, use device, gstreamer, url or test-pattern", c.kind)
+	}
+}
+
+// Fills the %d placeholders (width, height and fps) of a gstreamer pipeline, if it has any
+func fillPipeline(pipeline string, width int, height int, fps int) (string, error) {
+	if strings.TrimSpace(pipeline) == "" {
+		return "", fmt.Errorf("gstreamer-pipeline is empty")
+	}
+	if !strings.Contains(pipeline, "appsink") {
+		return "", fmt.Errorf("gstreamer-pipeline must end in an appsink, OpenCV reads the frames from it")
+	}
+	switch n := strings.Count(pipeline, "%"); n {
+	case 0:
+		return pipeline, nil
+	case 3:
+		filled := fmt.Sprintf(pipeline, width, height, fps)
+		if strings.Contains(filled, "%!") {
+			return "", fmt.Errorf("gstreamer-pipeline placeholders must be %%d: %s", filled)
+		}
+		return filled, nil
+	default:
+		return "", fmt.Errorf("gstreamer-pipeline must have no placeholders or three (width, height and fps), it has %d", n)
+	}
+}
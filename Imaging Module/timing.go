@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// Records when each processing stage of a frame ended, so the controller can report where the loop time goes
+type frameTimer struct {
+	extension  frameExtension
+	capturedAt time.Time // wall clock time the frame was read, used as the SensorOutput timestamp
+}
+
+// Starts timing a new frame, call this right before reading it from the camera
+func (t *frameTimer) start() {
+	t.extension = frameExtension{
+		start:  monotonicNow(),
+		stages: t.extension.stages[:0],
+	}
+}
+
+// Marks the frame as read from the camera, the "read" stage includes waiting for the camera
+func (t *frameTimer) captured() {
+	t.extension.capture = monotonicNow()
+	t.capturedAt = time.Now()
+	t.mark("read")
+}
+
+// Takes over the timestamps of another timer, so that timer can be reused for the next frame
+func (t *frameTimer) copyFrom(other *frameTimer) {
+	t.capturedAt = other.capturedAt
+	t.extension.start = other.extension.start
+	t.extension.capture = other.extension.capture
+	t.extension.stages = append(t.extension.stages[:0], other.extension.stages...)
+	t.extension.hasLane = false
+	t.extension.hasObstacle = false
+}
+
+// Marks the end of a stage, the stage started at the end of the previous one
+func (t *frameTimer) mark(stage string) {
+	t.extension.stages = append(t.extension.stages, stageTime{name: stage, end: monotonicNow()})
+}
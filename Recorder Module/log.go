@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Session log format
+//
+// A session log is a sequence of files <prefix>-<session start>-<index>.rlog. Every file starts with the
+// 8 byte magic "RVRLOG1\n", followed by records of
+//   stream        uint8   (see streamImaging and streamController)
+//   received at   int64   unix nanoseconds, little endian
+//   length        uvarint
+//   payload       []byte  the protobuf encoded SensorOutput, as received
+// A truncated last record (e.g. after a power loss) can be ignored by readers. Controller decisions carry the sequence
+// number of the imaging frame they respond to (see the controller's extension.go), so readers can pair them.
+
+const logMagic = "RVRLOG1\n"
+const logExtension = ".rlog"
+
+// Streams that can be recorded
+const (
+	streamImaging    = uint8(1) // imaging "path" output
+	streamController = uint8(2) // controller "decision" output
+)
+
+// Writes records to size-capped log files, rotating to a new file when the current one is full and
+// removing the oldest files when the total size of the directory exceeds the cap
+type logWriter struct {
+	lock         sync.Mutex
+	directory    string
+	prefix       string
+	maxFileSize  int64
+	maxTotalSize int64
+
+	file     *os.File
+	writer   *bufio.Writer
+	fileSize int64
+	index    int
+	header   [binary.MaxVarintLen64 + 9]byte
+}
+
+func newLogWriter(directory string, maxFileSize int64, maxTotalSize int64) (*logWriter, error) {
+	if maxFileSize <= 0 || maxTotalSize < maxFileSize {
+		return nil, fmt.Errorf("invalid log size caps: file %d, total %d", maxFileSize, maxTotalSize)
+	}
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := &logWriter{
+		directory:    directory,
+		prefix:       "session-" + time.Now().Format("20060102-150405"),
+		maxFileSize:  maxFileSize,
+		maxTotalSize: maxTotalSize,
+	}
+	err = w.rotate()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Appends a record
+func (w *logWriter) write(stream uint8, receivedAt time.Time, payload []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.writer == nil {
+		return fmt.Errorf("log writer is closed")
+	}
+
+	w.header[0] = stream
+	binary.LittleEndian.PutUint64(w.header[1:9], uint64(receivedAt.UnixNano()))
+	headerLength := 9 + binary.PutUvarint(w.header[9:], uint64(len(payload)))
+	recordSize := int64(headerLength + len(payload))
+
+	if w.fileSize+recordSize > w.maxFileSize && w.fileSize > int64(len(logMagic)) {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.writer.Write(w.header[:headerLength])
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.Write(payload)
+	if err != nil {
+		return err
+	}
+	w.fileSize += recordSize
+	return nil
+}
+
+// Flushes buffered records to disk
+func (w *logWriter) flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.writer == nil {
+		return nil
+	}
+	return w.writer.Flush()
+}
+
+// Flushes and closes the current file, the writer can not be used afterwards
+func (w *logWriter) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closeFile()
+}
+
+func (w *logWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.writer.Flush()
+	closeErr := w.file.Close()
+	w.file = nil
+	w.writer = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Closes the current file and starts the next one, enforcing the total size cap
+func (w *logWriter) rotate() error {
+	err := w.closeFile()
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(w.directory, fmt.Sprintf("%s-%04d%s", w.prefix, w.index, logExtension))
+	w.index++
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.writer = bufio.NewWriterSize(file, 64*1024)
+	_, err = w.writer.WriteString(logMagic)
+	if err != nil {
+		return err
+	}
+	w.fileSize = int64(len(logMagic))
+	log.Info().Str("file", name).Msg("Recording to new log file")
+
+	return w.enforceTotalSize(name)
+}
+
+// Removes the oldest log files in the directory until the total size (including a full current file) fits the cap
+func (w *logWriter) enforceTotalSize(current string) error {
+	entries, err := os.ReadDir(w.directory)
+	if err != nil {
+		return err
+	}
+
+	type logFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []logFile{}
+	total := w.maxFileSize // room for the file that was just started
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), logExtension) {
+			continue
+		}
+		path := filepath.Join(w.directory, entry.Name())
+		if path == current {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, logFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	// Files rotated within the resolution of the file system clock have the same time, their names sort by age
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].modTime.Equal(files[j].modTime) {
+			return files[i].path < files[j].path
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if total <= w.maxTotalSize {
+			break
+		}
+		err := os.Remove(file.path)
+		if err != nil {
+			return err
+		}
+		total -= file.size
+		log.Info().Str("file", file.path).Msg("Removed old log file to stay within the size cap")
+	}
+	return nil
+}
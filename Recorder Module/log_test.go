@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+type testRecord struct {
+	stream     uint8
+	receivedAt time.Time
+	payload    []byte
+}
+
+// Reads a log file back in the format documented at the top of log.go, like the replay tool does
+func readTestLog(t *testing.T, path string) []testRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	magic := make([]byte, len(logMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != logMagic {
+		t.Fatalf("%s does not start with the magic", path)
+	}
+	records := []testRecord{}
+	header := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("%s: truncated header after %d records", path, len(records))
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			t.Fatalf("%s: truncated length after %d records", path, len(records))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatalf("%s: truncated payload after %d records", path, len(records))
+		}
+		records = append(records, testRecord{
+			stream:     header[0],
+			receivedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(header[1:9]))),
+			payload:    payload,
+		})
+	}
+}
+
+// The log files in the directory, oldest first
+func logFiles(t *testing.T, directory string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(directory, "*"+logExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestLogWriterRotates(t *testing.T) {
+	directory := t.TempDir()
+	const maxFileSize, maxTotalSize = 1000, 3500
+	w, err := newLogWriter(directory, maxFileSize, maxTotalSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 records of 110 bytes (9 bytes header, 1 byte length, 100 bytes payload), about 9 per file
+	written := []testRecord{}
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 100; i++ {
+		record := testRecord{
+			stream:     streamImaging,
+			receivedAt: start.Add(time.Duration(i) * time.Millisecond),
+			payload:    bytes.Repeat([]byte{byte(i)}, 100),
+		}
+		if i%3 == 0 {
+			record.stream = streamController
+		}
+		if err := w.write(record.stream, record.receivedAt, record.payload); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, record)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.write(streamImaging, start, nil); err == nil {
+		t.Error("wrote to a closed writer")
+	}
+
+	paths := logFiles(t, directory)
+	total := int64(0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxFileSize {
+			t.Errorf("%s is %d bytes, above the file cap", path, info.Size())
+		}
+		total += info.Size()
+	}
+	if total > maxTotalSize {
+		t.Errorf("the logs take %d bytes, above the total cap", total)
+	}
+	if len(paths) < 2 || len(paths) >= 11 {
+		t.Fatalf("%d log files, want some removed after rotating about 11 times", len(paths))
+	}
+
+	// The remaining files hold the newest records, in order and without gaps
+	read := []testRecord{}
+	for _, path := range paths {
+		read = append(read, readTestLog(t, path)...)
+	}
+	newest := written[len(written)-len(read):]
+	for i, record := range read {
+		want := newest[i]
+		if record.stream != want.stream || !record.receivedAt.Equal(want.receivedAt) || !bytes.Equal(record.payload, want.payload) {
+			t.Fatalf("record %d of the remaining files is not record %d written", i, len(written)-len(read)+i)
+		}
+	}
+}
+
+func TestLogWriterOversizedRecord(t *testing.T) {
+	directory := t.TempDir()
+	w, err := newLogWriter(directory, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record larger than the file cap gets a file of its own instead of being dropped
+	for _, size := range []int{10, 200, 10} {
+		if err := w.write(streamImaging, time.Now(), make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	paths := logFiles(t, directory)
+	if len(paths) != 3 {
+		t.Fatalf("%d log files, want 3", len(paths))
+	}
+	for i, size := range []int{10, 200, 10} {
+		records := readTestLog(t, paths[i])
+		if len(records) != 1 || len(records[0].payload) != size {
+			t.Errorf("file %d does not hold the %d bytes record", i, size)
+		}
+	}
+}
+
+func TestNewLogWriterRejectsCaps(t *testing.T) {
+	for _, caps := range [][2]int64{{0, 1000}, {1000, 999}} {
+		if _, err := newLogWriter(t.TempDir(), caps[0], caps[1]); err == nil {
+			t.Errorf("accepted a file cap of %d with a total cap of %d", caps[0], caps[1])
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
+	servicerunner "github.com/VU-ASE/pkg-ServiceRunner/v2/src"
+	zmq "github.com/pebbe/zmq4"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// How often buffered records are flushed to disk
+const flushInterval = time.Second
+
+// The writer is global so that it can be flushed on termination
+var recording *logWriter
+
+// Closed on termination, the loop stops before the next record so it does not write to the closed recording
+var stopping = make(chan struct{})
+var stopOnce sync.Once
+
+// Creates a socket subscribed to all messages of the given address
+func subscribe(address string) (*zmq.Socket, error) {
+	sock, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return nil, err
+	}
+	err = sock.Connect(address)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	err = sock.SetSubscribe("") // Subscribe to all messages
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// Removes the debug JPEG from imaging output, which is by far the largest part of the message
+func stripDebugFrame(message []byte) ([]byte, error) {
+	sensorOutput := &pb_outputs.SensorOutput{}
+	err := proto.Unmarshal(message, sensorOutput)
+	if err != nil {
+		return nil, err
+	}
+	cameraOutput := sensorOutput.GetCameraOutput()
+	if cameraOutput == nil || cameraOutput.DebugFrame == nil {
+		return message, nil
+	}
+	cameraOutput.DebugFrame.Jpeg = nil
+	return proto.Marshal(sensorOutput)
+}
+
+// Runs the program logic
+func run(service servicerunner.ResolvedService, sysmanInfo servicerunner.SystemManagerInfo, tuning *pb_systemmanager_messages.TuningState) error {
+	// Fetch recording options
+	directory, err := servicerunner.GetTuningString("directory", tuning)
+	if err != nil {
+		return err
+	}
+	maxFileSize, err := servicerunner.GetTuningInt("max-file-size", tuning)
+	if err != nil {
+		return err
+	}
+	maxTotalSize, err := servicerunner.GetTuningInt("max-total-size", tuning)
+	if err != nil {
+		return err
+	}
+	stripDebugFrames, err := servicerunner.GetTuningInt("strip-debug-frames", tuning)
+	if err != nil {
+		return err
+	}
+
+	// Get the addresses of the outputs to record
+	imagingAddress, err := service.GetDependencyAddress("imaging", "path")
+	if err != nil {
+		return err
+	}
+	controllerAddress, err := service.GetDependencyAddress("controller", "decision")
+	if err != nil {
+		return err
+	}
+
+	imagingSock, err := subscribe(imagingAddress)
+	if err != nil {
+		return err
+	}
+	defer imagingSock.Close()
+	controllerSock, err := subscribe(controllerAddress)
+	if err != nil {
+		return err
+	}
+	defer controllerSock.Close()
+
+	recording, err = newLogWriter(directory, int64(maxFileSize)*1024*1024, int64(maxTotalSize)*1024*1024)
+	if err != nil {
+		return err
+	}
+	defer recording.close()
+
+	poller := zmq.NewPoller()
+	poller.Add(imagingSock, zmq.POLLIN)
+	poller.Add(controllerSock, zmq.POLLIN)
+	streams := map[*zmq.Socket]uint8{
+		imagingSock:    streamImaging,
+		controllerSock: streamController,
+	}
+
+	lastFlush := time.Now()
+	for {
+		select {
+		case <-stopping:
+			return nil
+		default:
+		}
+
+		polled, err := poller.Poll(flushInterval)
+		if zmq.AsErrno(err) == zmq.Errno(syscall.EINTR) {
+			// Interrupted by a signal, check if the service is terminated
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, socket := range polled {
+			message, err := socket.Socket.RecvBytes(0)
+			if err != nil {
+				return err
+			}
+			receivedAt := time.Now()
+
+			stream := streams[socket.Socket]
+			if stream == streamImaging && stripDebugFrames > 0 {
+				stripped, err := stripDebugFrame(message)
+				if err != nil {
+					log.Err(err).Msg("Failed to unmarshal imaging data, recording it as is")
+				} else {
+					message = stripped
+				}
+			}
+
+			err = recording.write(stream, receivedAt, message)
+			if err != nil {
+				select {
+				case <-stopping:
+					// Closed by onTerminate in the meantime
+					return nil
+				default:
+				}
+				log.Err(err).Msg("Failed to write record")
+				return err
+			}
+		}
+
+		if time.Since(lastFlush) >= flushInterval {
+			err = recording.flush()
+			if err != nil {
+				log.Err(err).Msg("Failed to flush recording")
+			}
+			lastFlush = time.Now()
+		}
+	}
+}
+
+func onTuningState(tuningState *pb_systemmanager_messages.TuningState) {
+	log.Warn().Msg("Tuning state received, recorder options are not mutable")
+}
+
+func onTerminate(sig os.Signal) {
+	log.Info().Msg("Terminating, flushing recording")
+	stopOnce.Do(func() { close(stopping) })
+	// The writer is locked, so this waits for a record that is being written
+	if recording != nil {
+		err := recording.close()
+		if err != nil {
+			log.Err(err).Msg("Failed to close recording")
+		}
+	}
+}
+
+// Used to start the program with the correct arguments
+func main() {
+	servicerunner.Run(run, onTuningState, onTerminate, false)
+}
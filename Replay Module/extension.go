@@ -0,0 +1,140 @@
+package main
+
+import (
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The frame extension the imaging module appends to its messages, see the controller's extension.go. The controller
+// echoes the sequence number (field 4) and session (field 5) of the frame in the same field of its decisions.
+const frameExtensionField = 1000
+
+// Identifies an imaging frame, and the decision that responds to it
+type frameRef struct {
+	session  uint64
+	sequence uint64 // 0 if the message is not numbered (older imaging modules and controllers)
+}
+
+// Decides which frame a decision responds to. Once the controller was seen numbering its decisions, decisions
+// without a number (manual driving, emergency stops) do not respond to a frame. Decisions of older controllers
+// are all unnumbered, they are taken as the response to the latest frame.
+type decisionMatcher struct {
+	numbered bool // the controller numbers its decisions
+}
+
+// Returns true if the decision responds to the frame
+func (d *decisionMatcher) matches(frame frameRef, decision frameRef) bool {
+	if decision.sequence > 0 {
+		d.numbered = true
+		return decision == frame
+	}
+	return !d.numbered
+}
+
+// Reads the session and sequence number from the unknown fields of a message
+func readFrameRef(b []byte) (frameRef, error) {
+	ref := frameRef{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ref, protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return ref, protowire.ParseError(m)
+		}
+		if num == frameExtensionField && typ == protowire.BytesType {
+			ext, _ := protowire.ConsumeBytes(b)
+			err := readFrameRefFields(ext, &ref)
+			if err != nil {
+				return ref, err
+			}
+		}
+		b = b[m:]
+	}
+	return ref, nil
+}
+
+func readFrameRefFields(b []byte, ref *frameRef) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ref.sequence = v
+			b = b[n:]
+		case num == 5 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ref.session = v
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// Copies the unknown fields of a message, dropping the monotonic times from the frame extension
+func withoutFrameTimes(b []byte) ([]byte, error) {
+	res := make([]byte, 0, len(b))
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		if num != frameExtensionField || typ != protowire.BytesType {
+			res = append(res, b[:n+m]...)
+			b = b[n+m:]
+			continue
+		}
+		ext, _ := protowire.ConsumeBytes(b[n:])
+		kept, err := dropFields(ext, 1, 2, 3)
+		if err != nil {
+			return nil, err
+		}
+		res = protowire.AppendTag(res, num, typ)
+		res = protowire.AppendBytes(res, kept)
+		b = b[n+m:]
+	}
+	return res, nil
+}
+
+// Copies the fields of an encoded message except the given ones
+func dropFields(b []byte, drop ...protowire.Number) ([]byte, error) {
+	res := make([]byte, 0, len(b))
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		if !slices.Contains(drop, num) {
+			res = append(res, b[:n+m]...)
+		}
+		b = b[n+m:]
+	}
+	return res, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestWithoutFrameTimes(t *testing.T) {
+	appendExtension := func(b []byte, withTimes bool) []byte {
+		var ext []byte
+		if withTimes {
+			ext = protowire.AppendTag(ext, 1, protowire.VarintType)
+			ext = protowire.AppendVarint(ext, 1000)
+			ext = protowire.AppendTag(ext, 2, protowire.VarintType)
+			ext = protowire.AppendVarint(ext, 2000)
+			ext = protowire.AppendTag(ext, 3, protowire.BytesType)
+			ext = protowire.AppendBytes(ext, []byte{0x10, 0x01})
+		}
+		ext = protowire.AppendTag(ext, 4, protowire.VarintType)
+		ext = protowire.AppendVarint(ext, 42)
+		ext = protowire.AppendTag(ext, 6, protowire.Fixed32Type)
+		ext = protowire.AppendFixed32(ext, 0x3f000000)
+		ext = protowire.AppendTag(ext, 10, protowire.Fixed32Type)
+		ext = protowire.AppendFixed32(ext, 0x3e800000)
+		b = protowire.AppendTag(b, frameExtensionField, protowire.BytesType)
+		return protowire.AppendBytes(b, ext)
+	}
+	// Another unknown field before the extension is kept as is
+	var other []byte
+	other = protowire.AppendTag(other, 999, protowire.VarintType)
+	other = protowire.AppendVarint(other, 7)
+
+	got, err := withoutFrameTimes(appendExtension(other, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := appendExtension(other, false); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	if _, err := withoutFrameTimes([]byte{0xff}); err == nil {
+		t.Error("no error for a truncated field")
+	}
+}
+
+// The unknown fields of a message with a frame extension holding only the sequence number and session
+func refExtension(ref frameRef) []byte {
+	var ext []byte
+	ext = protowire.AppendTag(ext, 4, protowire.VarintType)
+	ext = protowire.AppendVarint(ext, ref.sequence)
+	ext = protowire.AppendTag(ext, 5, protowire.Fixed64Type)
+	ext = protowire.AppendFixed64(ext, ref.session)
+	var b []byte
+	b = protowire.AppendTag(b, frameExtensionField, protowire.BytesType)
+	return protowire.AppendBytes(b, ext)
+}
+
+func TestReadFrameRef(t *testing.T) {
+	var other []byte
+	other = protowire.AppendTag(other, 999, protowire.BytesType)
+	other = protowire.AppendBytes(other, []byte{1, 2, 3})
+
+	tests := []struct {
+		name string
+		b    []byte
+		want frameRef
+	}{
+		{"no unknown fields", nil, frameRef{}},
+		{"decision extension", refExtension(frameRef{session: 7, sequence: 42}), frameRef{session: 7, sequence: 42}},
+		{"after another field", append(other, refExtension(frameRef{session: 7, sequence: 43})...), frameRef{session: 7, sequence: 43}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readFrameRef(test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+	if _, err := readFrameRef([]byte{0xff}); err == nil {
+		t.Error("no error for a truncated field")
+	}
+}
+
+func TestDecisionMatcher(t *testing.T) {
+	frame := frameRef{session: 7, sequence: 42}
+	tests := []struct {
+		name     string
+		numbered bool
+		frame    frameRef
+		decision frameRef
+		want     bool
+	}{
+		{"same frame", false, frame, frame, true},
+		{"late decision of the previous frame", false, frame, frameRef{session: 7, sequence: 41}, false},
+		{"other session", false, frame, frameRef{session: 8, sequence: 42}, false},
+		{"older controller", false, frame, frameRef{}, true},
+		{"older imaging module and controller", false, frameRef{}, frameRef{}, true},
+		{"unnumbered decision of a numbering controller", true, frame, frameRef{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matcher := decisionMatcher{numbered: test.numbered}
+			if got := matcher.matches(test.frame, test.decision); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// A numbered decision shows the controller numbers them, unnumbered ones are not matched afterwards
+	matcher := decisionMatcher{}
+	matcher.matches(frame, frame)
+	if matcher.matches(frame, frameRef{}) {
+		t.Error("matched an unnumbered decision after a numbered one")
+	}
+}
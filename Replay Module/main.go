@@ -0,0 +1,353 @@
+// Deterministic replay of recorded sessions into the controller.
+//
+// The imaging messages of a session log (see Recorder Module) are republished on the imaging "path" address,
+// with the original timing, scaled timing or in lockstep. Every decision the controller sends back is compared
+// with the decision that was recorded for the same frame, so changes to the controller can be checked on
+// real-world data. Stop the imaging module and (re)start the controller before replaying, so that the
+// controller starts from a clean state.
+//
+// Usage:
+//
+//	go run . -speed 1 -out diff.csv /home/debix/myFiles/recordings/session-20240601-101500-*.rlog
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	zmq "github.com/pebbe/zmq4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Decisions are considered equal if they differ less than this
+const decisionTolerance = 1e-6
+
+// An imaging message together with the controller decision that was recorded in response to it
+type replayFrame struct {
+	receivedAt time.Time
+	imaging    []byte
+	ref        frameRef
+	decision   *pb_outputs.ControllerOutput // nil if none was recorded
+}
+
+// A decision together with the frame it responds to
+type decision struct {
+	output *pb_outputs.ControllerOutput
+	ref    frameRef
+}
+
+// Pairs every imaging message with the controller decision that was recorded in response to it. Decisions echo the
+// sequence number of their frame, decisions of older controllers (without one) are paired with the frame before them.
+func buildFrames(records []record) []replayFrame {
+	frames := []replayFrame{}
+	decisions := []decision{}
+	matcher := decisionMatcher{}
+	for _, r := range records {
+		if r.stream != streamController {
+			continue
+		}
+		recorded, err := parseDecision(r.payload)
+		if err != nil {
+			log.Warn().Err(err).Msg("Skipping recorded decision")
+			recorded = decision{}
+		}
+		// Known up front, so that unnumbered decisions recorded before the first numbered one are not paired either
+		matcher.numbered = matcher.numbered || recorded.ref.sequence > 0
+		decisions = append(decisions, recorded)
+	}
+
+	numbered := map[frameRef]int{} // index in frames by frame reference
+	next := 0
+	for _, r := range records {
+		switch r.stream {
+		case streamImaging:
+			ref, err := readImagingRef(r.payload)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to read the frame extension of a recorded imaging message")
+			}
+			if ref.sequence > 0 {
+				numbered[ref] = len(frames)
+			}
+			frames = append(frames, replayFrame{receivedAt: r.receivedAt, imaging: r.payload, ref: ref})
+		case streamController:
+			recorded := decisions[next]
+			next++
+			if recorded.output == nil {
+				continue
+			}
+			i, ok := len(frames)-1, len(frames) > 0
+			if recorded.ref.sequence > 0 {
+				// The frame may be from before the recording started
+				i, ok = numbered[recorded.ref]
+			}
+			if !ok || frames[i].decision != nil || !matcher.matches(frames[i].ref, recorded.ref) {
+				continue
+			}
+			frames[i].decision = recorded.output
+		}
+	}
+	return frames
+}
+
+// Reads the frame reference of an imaging message
+func readImagingRef(message []byte) (frameRef, error) {
+	sensorOutput := &pb_outputs.SensorOutput{}
+	err := proto.Unmarshal(message, sensorOutput)
+	if err != nil {
+		return frameRef{}, err
+	}
+	return readFrameRef(sensorOutput.ProtoReflect().GetUnknown())
+}
+
+func parseDecision(message []byte) (decision, error) {
+	sensorOutput := &pb_outputs.SensorOutput{}
+	err := proto.Unmarshal(message, sensorOutput)
+	if err != nil {
+		return decision{}, err
+	}
+	controllerOutput := sensorOutput.GetControllerOutput()
+	if controllerOutput == nil {
+		return decision{}, fmt.Errorf("sensor output was not controller output")
+	}
+	ref, err := readFrameRef(sensorOutput.ProtoReflect().GetUnknown())
+	if err != nil {
+		return decision{}, err
+	}
+	return decision{output: controllerOutput, ref: ref}, nil
+}
+
+// Sets the timestamp of an imaging message to now, so the controller does not reject it as stale.
+// The monotonic times of the frame extension (fields 1 to 3) are from the recording session and are removed,
+// the controller then falls back to the timestamp. The rest of the extension (sequence, lane, obstacle) is kept.
+func restamp(message []byte) ([]byte, error) {
+	sensorOutput := &pb_outputs.SensorOutput{}
+	err := proto.Unmarshal(message, sensorOutput)
+	if err != nil {
+		return nil, err
+	}
+	sensorOutput.Timestamp = uint64(time.Now().UnixMilli())
+	unknown, err := withoutFrameTimes(sensorOutput.ProtoReflect().GetUnknown())
+	if err != nil {
+		return nil, err
+	}
+	sensorOutput.ProtoReflect().SetUnknown(unknown)
+	return proto.Marshal(sensorOutput)
+}
+
+// Collects the differences between the recorded and the replayed decisions
+type diffReport struct {
+	frames          int
+	missing         int // no decision received from the controller
+	unrecorded      int // no decision in the recording
+	changed         int
+	sumSquaredSteer float64
+	maxSteer        float64
+	maxThrottle     float64
+}
+
+func run() error {
+	pathAddress := flag.String("path-address", "tcp://*:9091", "address to publish the imaging messages on (the imaging path output)")
+	decisionAddress := flag.String("decision-address", "tcp://localhost:9791", "address of the controller decision output")
+	speed := flag.Float64("speed", 1, "replay speed, 1 is the original timing, 0 is lockstep (as fast as the controller responds)")
+	timeout := flag.Duration("timeout", 500*time.Millisecond, "how long to wait for a controller decision per frame")
+	warmup := flag.Duration("warmup", time.Second, "time to wait for the controller to connect before replaying")
+	restampFrames := flag.Bool("restamp", true, "replace the recorded timestamps with the time of sending")
+	outPath := flag.String("out", "", "csv file to write the per-frame comparison to (optional)")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return fmt.Errorf("no session log files given")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("speed must not be negative")
+	}
+
+	paths := flag.Args()
+	sort.Strings(paths)
+	records, err := readRecords(paths)
+	if err != nil {
+		return err
+	}
+	frames := buildFrames(records)
+	if len(frames) == 0 {
+		return fmt.Errorf("the session logs contain no imaging messages")
+	}
+	log.Info().Int("records", len(records)).Int("frames", len(frames)).Msg("Loaded session")
+
+	var csv *os.File
+	if *outPath != "" {
+		csv, err = os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer csv.Close()
+		fmt.Fprintln(csv, "frame,time,recorded_steering,replayed_steering,steering_diff,recorded_throttle,replayed_throttle,throttle_diff")
+	}
+
+	pathSock, err := zmq.NewSocket(zmq.PUB)
+	if err != nil {
+		return err
+	}
+	defer pathSock.Close()
+	err = pathSock.Bind(*pathAddress)
+	if err != nil {
+		return err
+	}
+
+	decisionSock, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return err
+	}
+	defer decisionSock.Close()
+	err = decisionSock.Connect(*decisionAddress)
+	if err != nil {
+		return err
+	}
+	err = decisionSock.SetSubscribe("")
+	if err != nil {
+		return err
+	}
+	poller := zmq.NewPoller()
+	poller.Add(decisionSock, zmq.POLLIN)
+
+	// ZMQ drops messages published before the subscriber is connected
+	time.Sleep(*warmup)
+
+	report := diffReport{}
+	matcher := decisionMatcher{}
+	start := time.Now()
+	for i, frame := range frames {
+		// Keep the (scaled) original spacing between frames
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(frame.receivedAt.Sub(frames[0].receivedAt)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+
+		message := frame.imaging
+		if *restampFrames {
+			message, err = restamp(message)
+			if err != nil {
+				log.Warn().Err(err).Int("frame", i).Msg("Failed to restamp imaging message, sending it as is")
+				message = frame.imaging
+			}
+		}
+		// Late decisions of the previous frame must not be paired with this one
+		err = drainDecisions(decisionSock, poller)
+		if err != nil {
+			return err
+		}
+		_, err = pathSock.SendBytes(message, 0)
+		if err != nil {
+			return err
+		}
+		report.frames++
+
+		replayed, err := waitForDecision(decisionSock, poller, &matcher, frame.ref, *timeout)
+		if err != nil {
+			return err
+		}
+		if replayed == nil {
+			report.missing++
+			log.Warn().Int("frame", i).Msg("No decision received from the controller")
+			continue
+		}
+		if frame.decision == nil {
+			report.unrecorded++
+			continue
+		}
+
+		steeringDiff := float64(replayed.GetSteeringAngle() - frame.decision.GetSteeringAngle())
+		throttleDiff := float64(replayed.GetLeftThrottle() - frame.decision.GetLeftThrottle())
+		if math.Abs(steeringDiff) > decisionTolerance || math.Abs(throttleDiff) > decisionTolerance {
+			report.changed++
+		}
+		report.sumSquaredSteer += steeringDiff * steeringDiff
+		report.maxSteer = math.Max(report.maxSteer, math.Abs(steeringDiff))
+		report.maxThrottle = math.Max(report.maxThrottle, math.Abs(throttleDiff))
+
+		if csv != nil {
+			fmt.Fprintf(csv, "%d,%.3f,%.5f,%.5f,%.5f,%.3f,%.3f,%.3f\n", i, frame.receivedAt.Sub(frames[0].receivedAt).Seconds(),
+				frame.decision.GetSteeringAngle(), replayed.GetSteeringAngle(), steeringDiff,
+				frame.decision.GetLeftThrottle(), replayed.GetLeftThrottle(), throttleDiff)
+		}
+	}
+
+	compared := report.frames - report.missing - report.unrecorded
+	rms := 0.0
+	if compared > 0 {
+		rms = math.Sqrt(report.sumSquaredSteer / float64(compared))
+	}
+	log.Info().
+		Int("frames", report.frames).
+		Int("compared", compared).
+		Int("changed", report.changed).
+		Int("missing", report.missing).
+		Int("unrecorded", report.unrecorded).
+		Float64("steeringRms", rms).
+		Float64("steeringMax", report.maxSteer).
+		Float64("throttleMax", report.maxThrottle).
+		Msg("Replay finished")
+	return nil
+}
+
+// Discards all decisions that are waiting to be received
+func drainDecisions(sock *zmq.Socket, poller *zmq.Poller) error {
+	for {
+		polled, err := poller.Poll(0)
+		if err != nil || len(polled) == 0 {
+			return err
+		}
+		_, err = sock.RecvBytes(0)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Waits for the controller decision for the given frame, returns nil if none arrived within the timeout.
+// Decisions for other frames (late ones of an earlier frame) are skipped.
+func waitForDecision(sock *zmq.Socket, poller *zmq.Poller, matcher *decisionMatcher, frame frameRef, timeout time.Duration) (*pb_outputs.ControllerOutput, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		polled, err := poller.Poll(remaining)
+		if err != nil {
+			return nil, err
+		}
+		if len(polled) == 0 {
+			return nil, nil
+		}
+		message, err := sock.RecvBytes(0)
+		if err != nil {
+			return nil, err
+		}
+		replayed, err := parseDecision(message)
+		if err != nil {
+			log.Warn().Err(err).Msg("Ignoring invalid controller message")
+			continue
+		}
+		if !matcher.matches(frame, replayed.ref) {
+			log.Debug().Uint64("sequence", replayed.ref.sequence).Uint64("want", frame.sequence).Msg("Ignoring decision for another frame")
+			continue
+		}
+		return replayed.output, nil
+	}
+}
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	err := run()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Replay failed")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reads session logs written by the recorder, see Recorder Module/log.go for the format
+
+const logMagic = "RVRLOG1\n"
+
+const (
+	streamImaging    = uint8(1)
+	streamController = uint8(2)
+)
+
+type record struct {
+	stream     uint8
+	receivedAt time.Time
+	payload    []byte
+}
+
+// Reads all records from the given log files, in order
+func readRecords(paths []string) ([]record, error) {
+	records := []record{}
+	for _, path := range paths {
+		fileRecords, err := readLogFile(path)
+		if errors.Is(err, errTruncated) {
+			// Happens when the recorder was killed, the complete records are still usable
+			log.Warn().Err(err).Msg("Ignoring truncated record")
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+	return records, nil
+}
+
+func readLogFile(path string) ([]record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	magic := make([]byte, len(logMagic))
+	_, err = io.ReadFull(reader, magic)
+	if err != nil || string(magic) != logMagic {
+		return nil, fmt.Errorf("%s is not a session log", path)
+	}
+
+	records := []record{}
+	header := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, truncated(path, len(records))
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return records, truncated(path, len(records))
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return records, truncated(path, len(records))
+		}
+		records = append(records, record{
+			stream:     header[0],
+			receivedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(header[1:9]))),
+			payload:    payload,
+		})
+	}
+}
+
+var errTruncated = errors.New("truncated record")
+
+func truncated(path string, count int) error {
+	return fmt.Errorf("%s: %w after %d records", path, errTruncated, count)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	pb_outputs "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/outputs"
+	pb_systemmanager_messages "github.com/VU-ASE/pkg-CommunicationDefinitions/v2/packages/go/systemmanager"
+	servicerunner "github.com/VU-ASE/pkg-ServiceRunner/v2/src"
+	zmq "github.com/pebbe/zmq4"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"rover/track"
+)
+
+// Physics step of the simulated rover
+const simulationStep = 5 * time.Millisecond
+
+// Kinematic bicycle model of the rover. Heading is counter-clockwise from the x axis,
+// a positive steering value from the controller turns right
+type rover struct {
+	x, y, heading float64
+	velocity      float64
+	steering      float64 // last steering value received, [-1,1]
+	throttle      float64 // last throttle received (average of left and right)
+}
+
+type roverParameters struct {
+	wheelbase        float64 // meters
+	maxSteeringAngle float64 // wheel angle (radians) at a steering value of 1
+	maxVelocity      float64 // meters per second at a throttle of 1
+}
+
+func (r *rover) step(params roverParameters, dt float64) {
+	r.velocity = r.throttle * params.maxVelocity
+	angle := r.steering * params.maxSteeringAngle
+	r.heading -= r.velocity / params.wheelbase * math.Tan(angle) * dt
+	r.x += r.velocity * math.Cos(r.heading) * dt
+	r.y += r.velocity * math.Sin(r.heading) * dt
+}
+
+// Keeps track of the cross-track error over the run, optionally writing every sample to a CSV file
+type crossTrackReport struct {
+	lock       sync.Mutex
+	start      time.Time
+	samples    int
+	sumSquared float64
+	maxAbs     float64
+	csv        *os.File
+}
+
+func newCrossTrackReport(csvPath string) (*crossTrackReport, error) {
+	report := &crossTrackReport{start: time.Now()}
+	if csvPath == "" {
+		return report, nil
+	}
+	file, err := os.Create(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintln(file, "time,x,y,heading,cross_track_error,steering,throttle")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	report.csv = file
+	return report, nil
+}
+
+func (c *crossTrackReport) add(r rover, crossTrackError float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.samples++
+	c.sumSquared += crossTrackError * crossTrackError
+	c.maxAbs = math.Max(c.maxAbs, math.Abs(crossTrackError))
+	if c.csv != nil {
+		fmt.Fprintf(c.csv, "%.3f,%.4f,%.4f,%.4f,%.4f,%.3f,%.3f\n", time.Since(c.start).Seconds(), r.x, r.y, r.heading, crossTrackError, r.steering, r.throttle)
+	}
+}
+
+// Returns the RMS and maximum absolute cross-track error so far
+func (c *crossTrackReport) summary() (float64, float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.samples == 0 {
+		return 0, 0
+	}
+	return math.Sqrt(c.sumSquared / float64(c.samples)), c.maxAbs
+}
+
+func (c *crossTrackReport) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.csv != nil {
+		c.csv.Close()
+		c.csv = nil
+	}
+}
+
+// The report is global so that it can be summarized on termination
+var report *crossTrackReport
+
+// Runs the program logic
+func run(service servicerunner.ResolvedService, sysmanInfo servicerunner.SystemManagerInfo, tuning *pb_systemmanager_messages.TuningState) error {
+	// Load the track
+	trackFile, err := servicerunner.GetTuningString("track-file", tuning)
+	if err != nil {
+		return err
+	}
+	trk, err := track.Load(trackFile)
+	if err != nil {
+		return err
+	}
+	grid := newTrackGrid(trk, 0.005)
+	log.Info().Str("track", trk.Name).Int("points", len(trk.Points)).Msg("Loaded track")
+
+	// Fetch image parameters, these should match the options of the imaging module
+	imgWidth, err := servicerunner.GetTuningInt("imgWidth", tuning)
+	if err != nil {
+		return err
+	}
+	imgHeight, err := servicerunner.GetTuningInt("imgHeight", tuning)
+	if err != nil {
+		return err
+	}
+	imgFps, err := servicerunner.GetTuningInt("imgFPS", tuning)
+	if err != nil {
+		return err
+	}
+	if imgWidth <= 0 || imgHeight <= 0 || imgFps <= 0 {
+		return fmt.Errorf("imgWidth, imgHeight and imgFPS must be positive")
+	}
+
+	// Build the camera model
+	view, err := servicerunner.GetTuningString("view", tuning)
+	if err != nil {
+		return err
+	}
+	var camera *cameraModel
+	switch view {
+	case "perspective":
+		cameraHeight, err := servicerunner.GetTuningFloat("camera-height", tuning)
+		if err != nil {
+			return err
+		}
+		cameraPitch, err := servicerunner.GetTuningFloat("camera-pitch", tuning)
+		if err != nil {
+			return err
+		}
+		cameraFov, err := servicerunner.GetTuningFloat("camera-fov", tuning)
+		if err != nil {
+			return err
+		}
+		camera = newPerspectiveCamera(imgWidth, imgHeight, float64(cameraHeight), float64(cameraPitch), float64(cameraFov))
+	case "topdown":
+		viewWidth, err := servicerunner.GetTuningFloat("topdown-width", tuning)
+		if err != nil {
+			return err
+		}
+		viewDepth, err := servicerunner.GetTuningFloat("topdown-depth", tuning)
+		if err != nil {
+			return err
+		}
+		camera = newTopDownCamera(imgWidth, imgHeight, float64(viewWidth), float64(viewDepth))
+	default:
+		return fmt.Errorf("unknown view %q, expected \"perspective\" or \"topdown\"", view)
+	}
+
+	// Fetch the rover model
+	params := roverParameters{}
+	for _, option := range []struct {
+		name  string
+		value *float64
+	}{
+		{"wheelbase", &params.wheelbase},
+		{"max-steering-angle", &params.maxSteeringAngle},
+		{"max-velocity", &params.maxVelocity},
+	} {
+		value, err := servicerunner.GetTuningFloat(option.name, tuning)
+		if err != nil {
+			return err
+		}
+		*option.value = float64(value)
+	}
+	if params.wheelbase <= 0 {
+		return fmt.Errorf("wheelbase must be positive")
+	}
+
+	reportFile, err := servicerunner.GetTuningString("report-file", tuning)
+	if err != nil {
+		return err
+	}
+	report, err = newCrossTrackReport(reportFile)
+	if err != nil {
+		return err
+	}
+	defer report.close()
+
+	// Serve the camera frames, point the gstreamer pipeline of the imaging module to this stream
+	streamAddress, err := servicerunner.GetTuningString("stream-address", tuning)
+	if err != nil {
+		return err
+	}
+	hub := newFrameHub()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", hub.serveStream)
+	mux.HandleFunc("/frame.jpg", hub.serveSnapshot)
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- http.ListenAndServe(streamAddress, mux)
+	}()
+	log.Info().Str("address", streamAddress).Msg("Serving simulated camera on /stream")
+
+	// Subscribe to the controller decisions
+	decisionAddress, err := service.GetDependencyAddress("controller", "decision")
+	if err != nil {
+		return err
+	}
+	decisionSock, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return err
+	}
+	defer decisionSock.Close()
+	err = decisionSock.Connect(decisionAddress)
+	if err != nil {
+		return err
+	}
+	err = decisionSock.SetSubscribe("")
+	if err != nil {
+		return err
+	}
+
+	// Start at the beginning of the track, facing the second point
+	state := rover{
+		x:       trk.Points[0][0],
+		y:       trk.Points[0][1],
+		heading: math.Atan2(trk.Points[1][1]-trk.Points[0][1], trk.Points[1][0]-trk.Points[0][0]),
+	}
+	stateLock := sync.Mutex{}
+
+	// Receive decisions
+	decisionErrors := make(chan error, 1)
+	go func() {
+		for {
+			decisionBytes, err := decisionSock.RecvBytes(0)
+			if err != nil {
+				decisionErrors <- err
+				return
+			}
+			decision := &pb_outputs.SensorOutput{}
+			err = proto.Unmarshal(decisionBytes, decision)
+			if err != nil {
+				log.Err(err).Msg("Failed to unmarshal controller output")
+				continue
+			}
+			controllerOutput := decision.GetControllerOutput()
+			if controllerOutput == nil {
+				log.Warn().Msg("Received sensor data that was not controller data")
+				continue
+			}
+			stateLock.Lock()
+			state.steering = math.Max(-1, math.Min(1, float64(controllerOutput.GetSteeringAngle())))
+			state.throttle = float64(controllerOutput.GetLeftThrottle()+controllerOutput.GetRightThrottle()) / 2
+			stateLock.Unlock()
+		}
+	}()
+
+	physicsTicker := time.NewTicker(simulationStep)
+	defer physicsTicker.Stop()
+	frameTicker := time.NewTicker(time.Second / time.Duration(imgFps))
+	defer frameTicker.Stop()
+	reportTicker := time.NewTicker(time.Second)
+	defer reportTicker.Stop()
+
+	frame := image.NewGray(image.Rect(0, 0, imgWidth, imgHeight))
+	for {
+		select {
+		case err := <-serverErrors:
+			return err
+		case err := <-decisionErrors:
+			return err
+		case <-physicsTicker.C:
+			stateLock.Lock()
+			state.step(params, simulationStep.Seconds())
+			snapshot := state
+			stateLock.Unlock()
+			report.add(snapshot, trk.CrossTrackError(snapshot.x, snapshot.y))
+		case <-frameTicker.C:
+			stateLock.Lock()
+			snapshot := state
+			stateLock.Unlock()
+			camera.render(grid, snapshot.x, snapshot.y, snapshot.heading, frame)
+			err := hub.publish(frame)
+			if err != nil {
+				log.Err(err).Msg("Failed to encode simulated frame")
+			}
+		case <-reportTicker.C:
+			stateLock.Lock()
+			snapshot := state
+			stateLock.Unlock()
+			rms, maxAbs := report.summary()
+			log.Info().
+				Float64("x", snapshot.x).
+				Float64("y", snapshot.y).
+				Float64("crossTrackError", trk.CrossTrackError(snapshot.x, snapshot.y)).
+				Float64("rms", rms).
+				Float64("max", maxAbs).
+				Msg("Simulation state")
+		}
+	}
+}
+
+func onTuningState(tuningState *pb_systemmanager_messages.TuningState) {
+	log.Warn().Msg("Tuning state received, simulator options are not mutable")
+}
+
+func onTerminate(sig os.Signal) {
+	if report == nil {
+		log.Info().Msg("Terminating")
+		return
+	}
+	rms, maxAbs := report.summary()
+	log.Info().Float64("rms", rms).Float64("max", maxAbs).Msg("Terminating, cross-track error over the run (meters)")
+	report.close()
+}
+
+// Used to start the program with the correct arguments
+func main() {
+	servicerunner.Run(run, onTuningState, onTerminate, false)
+}
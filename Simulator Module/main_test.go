@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testRoverParameters = roverParameters{wheelbase: 0.17, maxSteeringAngle: 0.4, maxVelocity: 2}
+
+// Drives the rover for a second in simulation steps
+func driveOneSecond(r *rover) {
+	for i := 0; i < int(time.Second/simulationStep); i++ {
+		r.step(testRoverParameters, simulationStep.Seconds())
+	}
+}
+
+func TestRoverStepStraight(t *testing.T) {
+	tests := []struct {
+		name    string
+		heading float64
+		wantX   float64
+		wantY   float64
+	}{
+		{"along x", 0, 1, 0},
+		{"along y", math.Pi / 2, 0, 1},
+		{"backwards along x", math.Pi, -1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := rover{heading: test.heading, throttle: 0.5}
+			driveOneSecond(&r)
+			if math.Abs(r.x-test.wantX) > 1e-9 || math.Abs(r.y-test.wantY) > 1e-9 || r.heading != test.heading {
+				t.Errorf("at (%f, %f) heading %f, want (%f, %f) heading %f", r.x, r.y, r.heading, test.wantX, test.wantY, test.heading)
+			}
+			if r.velocity != 1 {
+				t.Errorf("velocity %f, want 1", r.velocity)
+			}
+		})
+	}
+}
+
+func TestRoverStepSteering(t *testing.T) {
+	// Facing along x, y points left of the rover
+	right := rover{throttle: 0.2, steering: 0.5}
+	driveOneSecond(&right)
+	if right.heading >= 0 || right.y >= 0 {
+		t.Errorf("positive steering: heading %f at y %f, want a right turn (both negative)", right.heading, right.y)
+	}
+	left := rover{throttle: 0.2, steering: -0.5}
+	driveOneSecond(&left)
+	if left.heading <= 0 || left.y <= 0 {
+		t.Errorf("negative steering: heading %f at y %f, want a left turn (both positive)", left.heading, left.y)
+	}
+	// The turn follows the bicycle model
+	want := -0.4 / testRoverParameters.wheelbase * math.Tan(0.5*testRoverParameters.maxSteeringAngle)
+	if math.Abs(right.heading-want) > 1e-9 {
+		t.Errorf("heading %f after a second, want %f", right.heading, want)
+	}
+	standing := rover{steering: 1}
+	driveOneSecond(&standing)
+	if standing != (rover{steering: 1}) {
+		t.Errorf("the rover moved without throttle: %+v", standing)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Gray values used to render the track, the imaging module thresholds on the white lane
+const (
+	laneGray  = 235
+	floorGray = 40
+)
+
+// Describes where every pixel of the simulated camera looks at on the ground, in the frame of the rover
+// (forward in meters, right in meters). This is fixed for a camera, so it is only computed once
+type cameraModel struct {
+	width   int
+	height  int
+	forward []float64
+	right   []float64
+	visible []bool // false for pixels above the horizon
+}
+
+// A pinhole camera mounted at the given height (meters) and pitched down (radians), with the given
+// horizontal field of view (radians)
+func newPerspectiveCamera(width int, height int, cameraHeight float64, pitch float64, fov float64) *cameraModel {
+	model := newCameraModel(width, height)
+	focal := float64(width) / 2 / math.Tan(fov/2)
+	for v := 0; v < height; v++ {
+		for u := 0; u < width; u++ {
+			x := (float64(u) + 0.5 - float64(width)/2) / focal
+			y := (float64(v) + 0.5 - float64(height)/2) / focal
+			// Ray direction in the rover frame
+			forward := math.Cos(pitch) - y*math.Sin(pitch)
+			down := math.Sin(pitch) + y*math.Cos(pitch)
+			if down <= 0 {
+				continue
+			}
+			scale := cameraHeight / down
+			i := v*width + u
+			model.forward[i] = scale * forward
+			model.right[i] = scale * x
+			model.visible[i] = true
+		}
+	}
+	return model
+}
+
+// An orthographic bird's-eye view of the area in front of the rover, viewWidth x viewDepth meters
+func newTopDownCamera(width int, height int, viewWidth float64, viewDepth float64) *cameraModel {
+	model := newCameraModel(width, height)
+	for v := 0; v < height; v++ {
+		for u := 0; u < width; u++ {
+			i := v*width + u
+			model.forward[i] = (float64(height-v) - 0.5) / float64(height) * viewDepth
+			model.right[i] = (float64(u) + 0.5 - float64(width)/2) / float64(width) * viewWidth
+			model.visible[i] = true
+		}
+	}
+	return model
+}
+
+func newCameraModel(width int, height int) *cameraModel {
+	return &cameraModel{
+		width:   width,
+		height:  height,
+		forward: make([]float64, width*height),
+		right:   make([]float64, width*height),
+		visible: make([]bool, width*height),
+	}
+}
+
+// Renders the view of the camera for a rover at (x, y) with the given heading (radians, counter-clockwise from the x axis)
+func (c *cameraModel) render(grid *trackGrid, x float64, y float64, heading float64, dst *image.Gray) {
+	cos := math.Cos(heading)
+	sin := math.Sin(heading)
+	for i := range c.forward {
+		value := uint8(floorGray)
+		if c.visible[i] {
+			worldX := x + c.forward[i]*cos + c.right[i]*sin
+			worldY := y + c.forward[i]*sin - c.right[i]*cos
+			if grid.onLane(worldX, worldY) {
+				value = laneGray
+			}
+		}
+		dst.Pix[(i/c.width)*dst.Stride+i%c.width] = value
+	}
+}
+
+// Holds the latest encoded frame and wakes up all streaming clients when a new one arrives
+type frameHub struct {
+	lock    sync.Mutex
+	jpeg    []byte
+	updated chan struct{}
+}
+
+func newFrameHub() *frameHub {
+	return &frameHub{updated: make(chan struct{})}
+}
+
+// Encodes and publishes a new frame
+func (h *frameHub) publish(frame *image.Gray) error {
+	buf := bytes.Buffer{}
+	err := jpeg.Encode(&buf, frame, &jpeg.Options{Quality: 80})
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	h.jpeg = buf.Bytes()
+	close(h.updated)
+	h.updated = make(chan struct{})
+	h.lock.Unlock()
+	return nil
+}
+
+func (h *frameHub) latest() ([]byte, chan struct{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.jpeg, h.updated
+}
+
+// Serves the frames as an MJPEG stream (multipart/x-mixed-replace), which gstreamer (souphttpsrc ! multipartdemux),
+// OpenCV and browsers can all read
+func (h *frameHub) serveStream(w http.ResponseWriter, r *http.Request) {
+	const boundary = "frame"
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	log.Info().Str("client", r.RemoteAddr).Msg("Stream client connected")
+
+	_, updated := h.latest()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Info().Str("client", r.RemoteAddr).Msg("Stream client disconnected")
+			return
+		case <-updated:
+		}
+
+		var frame []byte
+		frame, updated = h.latest()
+		_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(frame))
+		if err == nil {
+			_, err = w.Write(frame)
+		}
+		if err == nil {
+			_, err = w.Write([]byte("\r\n"))
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("client", r.RemoteAddr).Msg("Failed to write to stream client")
+			return
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// Serves the latest frame as a single JPEG image
+func (h *frameHub) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	frame, _ := h.latest()
+	if frame == nil {
+		http.Error(w, "no frame rendered yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	_, _ = w.Write(frame)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+
+	"rover/track"
+)
+
+// A rasterized version of the lane, so that rendering is a single lookup per pixel
+type trackGrid struct {
+	originX    float64
+	originY    float64
+	resolution float64 // meters per cell
+	cols       int
+	rows       int
+	cells      []bool // true if the cell is on the (white) lane
+}
+
+// Rasterizes the lane of the track with the given resolution (meters per cell)
+func newTrackGrid(t *track.Track, resolution float64) *trackGrid {
+	halfWidth := t.LaneWidth / 2
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, point := range t.Points {
+		minX = math.Min(minX, point[0])
+		minY = math.Min(minY, point[1])
+		maxX = math.Max(maxX, point[0])
+		maxY = math.Max(maxY, point[1])
+	}
+
+	grid := &trackGrid{
+		originX:    minX - halfWidth - resolution,
+		originY:    minY - halfWidth - resolution,
+		resolution: resolution,
+	}
+	grid.cols = int(math.Ceil((maxX-minX+t.LaneWidth)/resolution)) + 2
+	grid.rows = int(math.Ceil((maxY-minY+t.LaneWidth)/resolution)) + 2
+	grid.cells = make([]bool, grid.cols*grid.rows)
+
+	// Only visit the cells around each segment
+	for i := 0; i < t.SegmentCount(); i++ {
+		from, to := t.Segment(i)
+		startCol, startRow := grid.cell(math.Min(from[0], to[0])-halfWidth, math.Min(from[1], to[1])-halfWidth)
+		endCol, endRow := grid.cell(math.Max(from[0], to[0])+halfWidth, math.Max(from[1], to[1])+halfWidth)
+		for row := max(startRow, 0); row <= min(endRow, grid.rows-1); row++ {
+			for col := max(startCol, 0); col <= min(endCol, grid.cols-1); col++ {
+				x := grid.originX + (float64(col)+0.5)*resolution
+				y := grid.originY + (float64(row)+0.5)*resolution
+				if distance, _ := track.DistanceToSegment(x, y, from, to); distance <= halfWidth {
+					grid.cells[row*grid.cols+col] = true
+				}
+			}
+		}
+	}
+	return grid
+}
+
+func (g *trackGrid) cell(x float64, y float64) (int, int) {
+	return int(math.Floor((x - g.originX) / g.resolution)), int(math.Floor((y - g.originY) / g.resolution))
+}
+
+// Returns true if the world coordinate lies on the lane
+func (g *trackGrid) onLane(x float64, y float64) bool {
+	col, row := g.cell(x, y)
+	if col < 0 || row < 0 || col >= g.cols || row >= g.rows {
+		return false
+	}
+	return g.cells[row*g.cols+col]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"rover/track"
+)
+
+func loadOval(t *testing.T) *track.Track {
+	t.Helper()
+	trk, err := track.Load("tracks/oval.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trk
+}
+
+// The oval starts on its bottom straight at y = -0.8, driven towards a larger x
+func TestCrossTrackErrorOval(t *testing.T) {
+	trk := loadOval(t)
+	tests := []struct {
+		name string
+		x, y float64
+		want float64
+	}{
+		{"on the centerline", 0, -0.8, 0},
+		{"right of the centerline", 0, -0.9, 0.1},
+		{"left of the centerline", 0, -0.7, -0.1},
+		{"off the lane to the right", 0.2, -1.3, 0.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := trk.CrossTrackError(test.x, test.y); math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("got %f, want %f", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrackGridOval(t *testing.T) {
+	trk := loadOval(t)
+	grid := newTrackGrid(trk, 0.005)
+	halfWidth := trk.LaneWidth / 2
+	tests := []struct {
+		name string
+		x, y float64
+		want bool
+	}{
+		{"on the centerline", 0, -0.8, true},
+		{"near the right edge", 0, -0.8 - halfWidth + 0.01, true},
+		{"near the left edge", 0, -0.8 + halfWidth - 0.01, true},
+		{"just beyond the right edge", 0, -0.8 - halfWidth - 0.01, false},
+		{"inside the oval", 0, 0, false},
+		{"outside the grid", 100, 100, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := grid.onLane(test.x, test.y); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+	// Every centerline point is on the lane
+	for i, point := range trk.Points {
+		if !grid.onLane(point[0], point[1]) {
+			t.Errorf("centerline point %d %v is not on the lane", i, point)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module rover/track
+
+go 1.22
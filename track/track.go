@@ -0,0 +1,87 @@
+// Package track reads the track files shared by the simulator and the accuracy tool (see Simulator Module/tracks)
+// and measures how far a position is from the centerline of a track.
+package track
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// A track as defined in a track file (see Simulator Module/tracks/oval.json). All coordinates are in meters,
+// x points right and y points up, the centerline is followed in the order of the points
+type Track struct {
+	Name      string       `json:"name"`
+	LaneWidth float64      `json:"laneWidth"` // width of the white lane in meters
+	Closed    bool         `json:"closed"`    // if true, the last point connects back to the first
+	Points    [][2]float64 `json:"points"`    // centerline of the lane
+}
+
+// Reads and validates a track file
+func Load(path string) (*Track, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	track := &Track{}
+	err = json.Unmarshal(data, track)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse track file %s: %w", path, err)
+	}
+	if len(track.Points) < 2 {
+		return nil, fmt.Errorf("track %s needs at least 2 centerline points, got %d", path, len(track.Points))
+	}
+	if track.LaneWidth <= 0 {
+		return nil, fmt.Errorf("track %s has invalid lane width %f", path, track.LaneWidth)
+	}
+	return track, nil
+}
+
+// Returns the number of centerline segments
+func (t *Track) SegmentCount() int {
+	if t.Closed {
+		return len(t.Points)
+	}
+	return len(t.Points) - 1
+}
+
+// Returns the start and end point of a centerline segment
+func (t *Track) Segment(i int) ([2]float64, [2]float64) {
+	return t.Points[i], t.Points[(i+1)%len(t.Points)]
+}
+
+// Returns the signed distance from (x, y) to the centerline, positive when the point is on the
+// right-hand side of the driving direction
+func (t *Track) CrossTrackError(x float64, y float64) float64 {
+	best := math.Inf(1)
+	bestSigned := 0.0
+	for i := 0; i < t.SegmentCount(); i++ {
+		from, to := t.Segment(i)
+		distance, side := DistanceToSegment(x, y, from, to)
+		if distance < best {
+			best = distance
+			bestSigned = distance * side
+		}
+	}
+	return bestSigned
+}
+
+// Returns the distance from (x, y) to the segment and the side it is on (1 for right, -1 for left)
+func DistanceToSegment(x float64, y float64, from [2]float64, to [2]float64) (float64, float64) {
+	dx := to[0] - from[0]
+	dy := to[1] - from[1]
+	lengthSquared := dx*dx + dy*dy
+	fraction := 0.0
+	if lengthSquared > 0 {
+		fraction = ((x-from[0])*dx + (y-from[1])*dy) / lengthSquared
+		fraction = math.Max(0, math.Min(1, fraction))
+	}
+	px := from[0] + fraction*dx
+	py := from[1] + fraction*dy
+	side := 1.0
+	if dx*(y-from[1])-dy*(x-from[0]) > 0 {
+		side = -1.0
+	}
+	return math.Hypot(x-px, y-py), side
+}